@@ -0,0 +1,412 @@
+package pgpmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Autocrypt Level 1 is defined in https://autocrypt.org/level1.html
+
+// PreferEncrypt is the encryption preference advertised in an Autocrypt
+// header.
+type PreferEncrypt string
+
+const (
+	PreferEncryptNoPreference PreferEncrypt = "nopreference"
+	PreferEncryptMutual       PreferEncrypt = "mutual"
+)
+
+// Autocrypt contains the information advertised in an Autocrypt header.
+type Autocrypt struct {
+	Addr          string
+	PreferEncrypt PreferEncrypt
+	Key           *openpgp.Entity
+}
+
+// ReadAutocrypt parses and validates the Autocrypt header fields of a message.
+// If the message doesn't contain any Autocrypt header field or is a
+// multipart/report message, ReadAutocrypt returns nil without an error.
+//
+// Header fields whose addr attribute doesn't match the From address are
+// ignored. An error is returned if the message has more than one valid
+// Autocrypt header field. Keys are checked against the time given by config.
+func ReadAutocrypt(h textproto.Header, config *packet.Config) (*Autocrypt, error) {
+	return readAutocrypt(h, config.Now())
+}
+
+func readAutocrypt(h textproto.Header, now time.Time) (*Autocrypt, error) {
+	values := h.Values("Autocrypt")
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	if isReport(h) {
+		return nil, nil
+	}
+
+	from, err := singleFromAddress(h)
+	if err != nil {
+		return nil, err
+	}
+
+	var ac *Autocrypt
+	var firstErr error
+	for _, v := range values {
+		parsed, err := parseAutocrypt(v, false, now)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if !strings.EqualFold(parsed.Addr, from) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("pgpmail: Autocrypt addr %q doesn't match From address %q", parsed.Addr, from)
+			}
+			continue
+		}
+
+		if ac != nil {
+			return nil, fmt.Errorf("pgpmail: message contains more than one Autocrypt header field")
+		}
+		ac = parsed
+	}
+
+	if ac == nil {
+		return nil, firstErr
+	}
+	return ac, nil
+}
+
+// isReport returns true if h is the header of a multipart/report message.
+// Delivery reports may quote the original sender's header fields, so they are
+// ignored by Autocrypt.
+func isReport(h textproto.Header) bool {
+	t, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && strings.EqualFold(t, "multipart/report")
+}
+
+// recipientAddresses returns the addresses of the To and Cc header fields.
+func recipientAddresses(h textproto.Header) ([]*mail.Address, error) {
+	mh := mail.Header{Header: message.Header{Header: h}}
+	var recipients []*mail.Address
+	for _, k := range []string{"To", "Cc"} {
+		addrs, err := mh.AddressList(k)
+		if err != nil {
+			return nil, fmt.Errorf("pgpmail: failed to parse %v header field: %v", k, err)
+		}
+		recipients = append(recipients, addrs...)
+	}
+	return recipients, nil
+}
+
+// parseAutocrypt parses the value of an Autocrypt or Autocrypt-Gossip header
+// field. The key must have a valid encryption key at now.
+func parseAutocrypt(v string, gossip bool, now time.Time) (*Autocrypt, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(v, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("pgpmail: malformed Autocrypt attribute %q", attr)
+		}
+		k, v := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+
+		if _, ok := attrs[k]; ok {
+			return nil, fmt.Errorf("pgpmail: duplicate Autocrypt attribute %q", k)
+		}
+		attrs[k] = v
+	}
+
+	ac := &Autocrypt{PreferEncrypt: PreferEncryptNoPreference}
+	for k, v := range attrs {
+		switch k {
+		case "addr":
+			ac.Addr = v
+		case "prefer-encrypt":
+			// Gossip doesn't convey any preference, and unknown values are
+			// treated as nopreference
+			if !gossip && PreferEncrypt(v) == PreferEncryptMutual {
+				ac.PreferEncrypt = PreferEncryptMutual
+			}
+		case "keydata":
+			key, err := parseAutocryptKeyData(v, now)
+			if err != nil {
+				return nil, err
+			}
+			ac.Key = key
+		default:
+			// Attributes starting with an underscore are non-critical
+			if !strings.HasPrefix(k, "_") {
+				return nil, fmt.Errorf("pgpmail: unknown critical Autocrypt attribute %q", k)
+			}
+		}
+	}
+
+	if ac.Addr == "" {
+		return nil, fmt.Errorf("pgpmail: missing Autocrypt addr attribute")
+	}
+	if ac.Key == nil {
+		return nil, fmt.Errorf("pgpmail: missing Autocrypt keydata attribute")
+	}
+	return ac, nil
+}
+
+func parseAutocryptKeyData(v string, now time.Time) (*openpgp.Entity, error) {
+	// Folding whitespace may appear anywhere in the base64 data
+	v = strings.Join(strings.Fields(v), "")
+
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to decode Autocrypt keydata: %v", err)
+	}
+
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to read Autocrypt keydata: %v", err)
+	}
+	if len(el) != 1 {
+		return nil, fmt.Errorf("pgpmail: Autocrypt keydata contains %v keys, want exactly one", len(el))
+	}
+
+	if _, ok := el[0].EncryptionKey(now); !ok {
+		return nil, fmt.Errorf("pgpmail: Autocrypt key has no valid encryption key")
+	}
+	return el[0], nil
+}
+
+// readAutocryptGossip parses the Autocrypt-Gossip header fields in the
+// cleartext header of an encrypted message. Invalid fields and fields whose
+// addr attribute isn't a recipient of the message are ignored.
+func readAutocryptGossip(h, cleartextHeader textproto.Header, now time.Time) []*Autocrypt {
+	values := cleartextHeader.Values("Autocrypt-Gossip")
+	if len(values) == 0 {
+		return nil
+	}
+
+	recipients, err := recipientAddresses(h)
+	if err != nil {
+		return nil
+	}
+
+	var gossip []*Autocrypt
+	for _, v := range values {
+		ac, err := parseAutocrypt(v, true, now)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range recipients {
+			if strings.EqualFold(ac.Addr, addr.Address) {
+				gossip = append(gossip, ac)
+				break
+			}
+		}
+	}
+	return gossip
+}
+
+// autocryptEntity returns a minimal version of e suitable for Autocrypt
+// header fields: the primary key, the user ID matching addr and the
+// encryption key, along with their self-signatures.
+func autocryptEntity(e *openpgp.Entity, addr string, now time.Time) (*openpgp.Entity, error) {
+	ident := e.PrimaryIdentity()
+	if ident == nil {
+		return nil, fmt.Errorf("pgpmail: key has no identity")
+	}
+	if !strings.EqualFold(ident.UserId.Email, addr) {
+		var names []string
+		for name, other := range e.Identities {
+			if strings.EqualFold(other.UserId.Email, addr) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			ident = e.Identities[names[0]]
+		}
+	}
+	if ident.SelfSignature == nil {
+		return nil, fmt.Errorf("pgpmail: user ID %q has no self-signature", ident.Name)
+	}
+
+	minimized := &openpgp.Entity{
+		PrimaryKey: e.PrimaryKey,
+		Identities: map[string]*openpgp.Identity{
+			ident.Name: {
+				Name:          ident.Name,
+				UserId:        ident.UserId,
+				SelfSignature: ident.SelfSignature,
+				Signatures:    []*packet.Signature{ident.SelfSignature},
+			},
+		},
+		Subkeys: e.Subkeys,
+	}
+
+	key, ok := minimized.EncryptionKey(now)
+	if !ok {
+		return nil, fmt.Errorf("pgpmail: key has no valid encryption key")
+	}
+	minimized.Subkeys = nil
+	for _, subkey := range e.Subkeys {
+		if subkey.PublicKey == key.PublicKey {
+			minimized.Subkeys = []openpgp.Subkey{{
+				PublicKey: subkey.PublicKey,
+				Sig:       subkey.Sig,
+			}}
+			break
+		}
+	}
+
+	return minimized, nil
+}
+
+// autocryptLineLen is the maximum length of the lines of a folded Autocrypt
+// header field, excluding the CRLF.
+const autocryptLineLen = 78
+
+// autocryptKeyDataLineLen is the number of base64 characters per line of
+// folded keydata, so that lines don't exceed 78 characters.
+const autocryptKeyDataLineLen = 76
+
+// formatAutocrypt formats an Autocrypt or Autocrypt-Gossip header field,
+// including the trailing CRLF. The field is folded so that lines don't exceed
+// 78 characters, unless the address alone is longer.
+func formatAutocrypt(k string, ac *Autocrypt) ([]byte, error) {
+	var keyBuf bytes.Buffer
+	if err := ac.Key.Serialize(&keyBuf); err != nil {
+		return nil, err
+	}
+	keydata := base64.StdEncoding.EncodeToString(keyBuf.Bytes())
+
+	var buf bytes.Buffer
+	line := fmt.Sprintf("%v: addr=%v;", k, ac.Addr)
+	if len(line) > autocryptLineLen {
+		// Fold after addr=
+		fmt.Fprintf(&buf, "%v: addr=\r\n", k)
+		line = fmt.Sprintf(" %v;", ac.Addr)
+	}
+	attrs := []string{" keydata="}
+	if ac.PreferEncrypt == PreferEncryptMutual {
+		attrs = append([]string{fmt.Sprintf(" prefer-encrypt=%v;", ac.PreferEncrypt)}, attrs...)
+	}
+	for _, attr := range attrs {
+		if len(line)+len(attr) > autocryptLineLen {
+			buf.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += attr
+	}
+	buf.WriteString(line + "\r\n")
+	for len(keydata) > 0 {
+		n := autocryptKeyDataLineLen
+		if n > len(keydata) {
+			n = len(keydata)
+		}
+		buf.WriteString(" " + keydata[:n] + "\r\n")
+		keydata = keydata[n:]
+	}
+	return buf.Bytes(), nil
+}
+
+// singleFromAddress returns the address of the From header field, which must
+// contain exactly one address.
+func singleFromAddress(h textproto.Header) (string, error) {
+	mh := mail.Header{Header: message.Header{Header: h}}
+	from, err := mh.AddressList("From")
+	if err != nil {
+		return "", fmt.Errorf("pgpmail: failed to parse From header field: %v", err)
+	}
+	if len(from) != 1 {
+		return "", fmt.Errorf("pgpmail: Autocrypt requires exactly one From address, got %v", len(from))
+	}
+	return from[0].Address, nil
+}
+
+// writeAutocrypt adds an Autocrypt header field advertising e to h.
+func writeAutocrypt(h *textproto.Header, e *openpgp.Entity, preferEncrypt PreferEncrypt, now time.Time) error {
+	if e == nil {
+		return errorf(ErrMissingKey, "pgpmail: Autocrypt requires a signing key")
+	}
+
+	addr, err := singleFromAddress(*h)
+	if err != nil {
+		return err
+	}
+
+	key, err := autocryptEntity(e, addr, now)
+	if err != nil {
+		return err
+	}
+
+	if preferEncrypt != PreferEncryptMutual {
+		preferEncrypt = PreferEncryptNoPreference
+	}
+	field, err := formatAutocrypt("Autocrypt", &Autocrypt{
+		Addr:          addr,
+		PreferEncrypt: preferEncrypt,
+		Key:           key,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Del("Autocrypt")
+	h.AddRaw(field)
+	return nil
+}
+
+// autocryptGossip formats Autocrypt-Gossip header fields for the recipients
+// of an encrypted message. h is the outer header of the message.
+func autocryptGossip(h textproto.Header, to []*openpgp.Entity, now time.Time) ([][]byte, error) {
+	recipients, err := recipientAddresses(h)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields [][]byte
+	for _, e := range to {
+		// Only gossip keys of visible recipients: keys of Bcc recipients
+		// must not be disclosed
+		var addr string
+	recipientsLoop:
+		for _, rcpt := range recipients {
+			for _, ident := range e.Identities {
+				if strings.EqualFold(ident.UserId.Email, rcpt.Address) {
+					addr = rcpt.Address
+					break recipientsLoop
+				}
+			}
+		}
+		if addr == "" {
+			continue
+		}
+
+		key, err := autocryptEntity(e, addr, now)
+		if err != nil {
+			return nil, err
+		}
+		field, err := formatAutocrypt("Autocrypt-Gossip", &Autocrypt{Addr: addr, Key: key})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
@@ -0,0 +1,416 @@
+package pgpmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// AutocryptPeer is the Autocrypt state kept for a peer address. See Autocrypt
+// Level 1 section 2.3.
+type AutocryptPeer struct {
+	Addr               string
+	LastSeen           time.Time
+	AutocryptTimestamp time.Time
+	PublicKey          *openpgp.Entity
+	PreferEncrypt      PreferEncrypt
+	GossipTimestamp    time.Time
+	GossipKey          *openpgp.Entity
+}
+
+// AutocryptStore stores Autocrypt peer state.
+type AutocryptStore interface {
+	// Peer returns the state stored for addr, or nil if there is none.
+	Peer(addr string) (*AutocryptPeer, error)
+	// SetPeer stores the state of a peer, replacing any previous state for the
+	// same address.
+	SetPeer(peer *AutocryptPeer) error
+}
+
+func normalizeAutocryptAddr(addr string) string {
+	return strings.ToLower(addr)
+}
+
+// MemoryAutocryptStore is an AutocryptStore keeping peer state in memory.
+type MemoryAutocryptStore struct {
+	mutex sync.Mutex
+	peers map[string]*AutocryptPeer
+}
+
+var _ AutocryptStore = (*MemoryAutocryptStore)(nil)
+
+// NewMemoryAutocryptStore creates a new empty in-memory store.
+func NewMemoryAutocryptStore() *MemoryAutocryptStore {
+	return &MemoryAutocryptStore{peers: make(map[string]*AutocryptPeer)}
+}
+
+func (s *MemoryAutocryptStore) Peer(addr string) (*AutocryptPeer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peer, ok := s.peers[normalizeAutocryptAddr(addr)]
+	if !ok {
+		return nil, nil
+	}
+	copy := *peer
+	return &copy, nil
+}
+
+func (s *MemoryAutocryptStore) SetPeer(peer *AutocryptPeer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	copy := *peer
+	s.peers[normalizeAutocryptAddr(peer.Addr)] = &copy
+	return nil
+}
+
+// FileAutocryptStore is an AutocryptStore keeping peer state in a JSON file.
+//
+// The whole file is loaded in memory, and rewritten each time a peer is
+// updated.
+type FileAutocryptStore struct {
+	path string
+	mem  *MemoryAutocryptStore
+}
+
+var _ AutocryptStore = (*FileAutocryptStore)(nil)
+
+type fileAutocryptPeer struct {
+	Addr               string        `json:"addr"`
+	LastSeen           time.Time     `json:"last_seen"`
+	AutocryptTimestamp time.Time     `json:"autocrypt_timestamp"`
+	PublicKey          []byte        `json:"public_key,omitempty"`
+	PreferEncrypt      PreferEncrypt `json:"prefer_encrypt"`
+	GossipTimestamp    time.Time     `json:"gossip_timestamp"`
+	GossipKey          []byte        `json:"gossip_key,omitempty"`
+}
+
+func serializeEntity(e *openpgp.Entity) ([]byte, error) {
+	if e == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := e.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func parseEntity(b []byte) (*openpgp.Entity, error) {
+	if b == nil {
+		return nil, nil
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if len(el) != 1 {
+		return nil, fmt.Errorf("pgpmail: expected exactly one key, got %v", len(el))
+	}
+	return el[0], nil
+}
+
+// OpenFileAutocryptStore opens a file-backed store. The file is created on the
+// first update if it doesn't exist.
+func OpenFileAutocryptStore(path string) (*FileAutocryptStore, error) {
+	s := &FileAutocryptStore{path: path, mem: NewMemoryAutocryptStore()}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var peers []fileAutocryptPeer
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to parse Autocrypt store %q: %v", path, err)
+	}
+
+	for _, fp := range peers {
+		peer := &AutocryptPeer{
+			Addr:               fp.Addr,
+			LastSeen:           fp.LastSeen,
+			AutocryptTimestamp: fp.AutocryptTimestamp,
+			PreferEncrypt:      fp.PreferEncrypt,
+			GossipTimestamp:    fp.GossipTimestamp,
+		}
+		if peer.PublicKey, err = parseEntity(fp.PublicKey); err != nil {
+			return nil, fmt.Errorf("pgpmail: failed to read public key for %q in Autocrypt store: %v", fp.Addr, err)
+		}
+		if peer.GossipKey, err = parseEntity(fp.GossipKey); err != nil {
+			return nil, fmt.Errorf("pgpmail: failed to read gossip key for %q in Autocrypt store: %v", fp.Addr, err)
+		}
+		s.mem.peers[normalizeAutocryptAddr(peer.Addr)] = peer
+	}
+
+	return s, nil
+}
+
+func (s *FileAutocryptStore) Peer(addr string) (*AutocryptPeer, error) {
+	return s.mem.Peer(addr)
+}
+
+func (s *FileAutocryptStore) SetPeer(peer *AutocryptPeer) error {
+	s.mem.mutex.Lock()
+	defer s.mem.mutex.Unlock()
+
+	addr := normalizeAutocryptAddr(peer.Addr)
+	prev, hadPrev := s.mem.peers[addr]
+	copy := *peer
+	s.mem.peers[addr] = &copy
+
+	if err := s.save(); err != nil {
+		// Keep the in-memory state consistent with the file
+		if hadPrev {
+			s.mem.peers[addr] = prev
+		} else {
+			delete(s.mem.peers, addr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileAutocryptStore) save() error {
+	addrs := make([]string, 0, len(s.mem.peers))
+	for addr := range s.mem.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	peers := make([]fileAutocryptPeer, 0, len(addrs))
+	for _, addr := range addrs {
+		peer := s.mem.peers[addr]
+		fp := fileAutocryptPeer{
+			Addr:               peer.Addr,
+			LastSeen:           peer.LastSeen,
+			AutocryptTimestamp: peer.AutocryptTimestamp,
+			PreferEncrypt:      peer.PreferEncrypt,
+			GossipTimestamp:    peer.GossipTimestamp,
+		}
+		var err error
+		if fp.PublicKey, err = serializeEntity(peer.PublicKey); err != nil {
+			return err
+		}
+		if fp.GossipKey, err = serializeEntity(peer.GossipKey); err != nil {
+			return err
+		}
+		peers = append(peers, fp)
+	}
+
+	b, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first to avoid corrupting the store
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// UpdateAutocrypt updates the peer state in store with a message read by
+// Read, as described in Autocrypt Level 1 sections 2.3 and 2.7. The message
+// body should have been read before calling UpdateAutocrypt, so that the
+// signature covering Autocrypt-Gossip header fields has been checked.
+//
+// now is used to clamp message dates in the future.
+func UpdateAutocrypt(store AutocryptStore, r *Reader, now time.Time) error {
+	if isReport(r.Header) {
+		return nil
+	}
+
+	mh := mail.Header{Header: message.Header{Header: r.Header}}
+
+	from, err := mh.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return nil
+	}
+	addr := from[0].Address
+
+	date, err := mh.Date()
+	if err != nil || date.IsZero() || date.After(now) {
+		date = now
+	}
+
+	peer, err := store.Peer(addr)
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		peer = &AutocryptPeer{Addr: addr}
+	}
+
+	if !date.Before(peer.AutocryptTimestamp) {
+		// Invalid Autocrypt header fields are treated as missing
+		ac, _ := readAutocrypt(r.Header, now)
+
+		if date.After(peer.LastSeen) {
+			peer.LastSeen = date
+		}
+		if ac != nil {
+			peer.AutocryptTimestamp = date
+			peer.PublicKey = ac.Key
+			peer.PreferEncrypt = ac.PreferEncrypt
+		}
+
+		if err := store.SetPeer(peer); err != nil {
+			return err
+		}
+	}
+
+	if md := r.MessageDetails; md != nil && md.IsSigned && md.SignatureError != nil {
+		return nil
+	}
+
+	for _, gossip := range r.AutocryptGossip {
+		peer, err := store.Peer(gossip.Addr)
+		if err != nil {
+			return err
+		}
+		if peer == nil {
+			peer = &AutocryptPeer{Addr: gossip.Addr}
+		}
+
+		if peer.GossipTimestamp.After(date) {
+			continue
+		}
+		peer.GossipTimestamp = date
+		peer.GossipKey = gossip.Key
+
+		if err := store.SetPeer(peer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Recommendation is an Autocrypt UI recommendation. See Autocrypt Level 1
+// section 2.4.
+type Recommendation int
+
+const (
+	// RecommendDisable indicates that encryption isn't possible.
+	RecommendDisable Recommendation = iota
+	// RecommendDiscourage indicates that encryption is possible, but may be
+	// unreadable by the recipient.
+	RecommendDiscourage
+	// RecommendAvailable indicates that encryption is possible.
+	RecommendAvailable
+	// RecommendEncrypt indicates that encryption should be enabled by
+	// default.
+	RecommendEncrypt
+)
+
+func (rec Recommendation) String() string {
+	switch rec {
+	case RecommendDisable:
+		return "disable"
+	case RecommendDiscourage:
+		return "discourage"
+	case RecommendAvailable:
+		return "available"
+	case RecommendEncrypt:
+		return "encrypt"
+	}
+	return fmt.Sprintf("Recommendation(%d)", int(rec))
+}
+
+// autocryptStaleDuration is the delay after which an Autocrypt key is
+// considered stale if the peer kept sending messages without it.
+const autocryptStaleDuration = 35 * 24 * time.Hour
+
+// RecommendAutocrypt computes the Autocrypt UI recommendation for a message
+// sent to recipients. preferEncrypt is the preference of the sender's own
+// account, and replyToEncrypted indicates whether the message is a reply to
+// an encrypted message.
+//
+// Unless the recommendation is RecommendDisable, the keys to encrypt the
+// message to are returned, one per recipient.
+func RecommendAutocrypt(store AutocryptStore, recipients []string, preferEncrypt PreferEncrypt, replyToEncrypted bool, now time.Time) (Recommendation, []*openpgp.Entity, error) {
+	if len(recipients) == 0 {
+		return RecommendDisable, nil, nil
+	}
+
+	keys := make([]*openpgp.Entity, len(recipients))
+	allEncrypt := true
+	discourage := false
+	for i, addr := range recipients {
+		peer, err := store.Peer(addr)
+		if err != nil {
+			return RecommendDisable, nil, err
+		}
+
+		rec, key := recommendPeer(peer, now)
+		if rec == RecommendDisable {
+			return RecommendDisable, nil, nil
+		}
+		keys[i] = key
+
+		if replyToEncrypted || (rec == RecommendAvailable && peer.PreferEncrypt == PreferEncryptMutual && preferEncrypt == PreferEncryptMutual) {
+			rec = RecommendEncrypt
+		}
+		if rec != RecommendEncrypt {
+			allEncrypt = false
+		}
+		if rec == RecommendDiscourage {
+			discourage = true
+		}
+	}
+
+	switch {
+	case allEncrypt:
+		return RecommendEncrypt, keys, nil
+	case discourage:
+		return RecommendDiscourage, keys, nil
+	default:
+		return RecommendAvailable, keys, nil
+	}
+}
+
+// recommendPeer computes the preliminary recommendation for a single peer.
+func recommendPeer(peer *AutocryptPeer, now time.Time) (Recommendation, *openpgp.Entity) {
+	if peer == nil {
+		return RecommendDisable, nil
+	}
+
+	key, gossip := peer.PublicKey, false
+	if key == nil {
+		key, gossip = peer.GossipKey, true
+	}
+	if key == nil {
+		return RecommendDisable, nil
+	}
+	if _, ok := key.EncryptionKey(now); !ok {
+		return RecommendDisable, nil
+	}
+
+	if gossip || peer.AutocryptTimestamp.Add(autocryptStaleDuration).Before(peer.LastSeen) {
+		return RecommendDiscourage, key
+	}
+	return RecommendAvailable, key
+}
@@ -0,0 +1,200 @@
+package pgpmail
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message/textproto"
+)
+
+func testAutocryptReader(date time.Time, autocrypt string) *Reader {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("Date", date.Format(time.RFC1123Z))
+	if autocrypt != "" {
+		h.Set("Autocrypt", autocrypt)
+	}
+	return &Reader{Header: h, MessageDetails: &openpgp.MessageDetails{}}
+}
+
+func TestUpdateAutocrypt(t *testing.T) {
+	keydata := testAutocryptKeyData()
+	store := NewMemoryAutocryptStore()
+	now := time.Now().Truncate(time.Second)
+
+	r := testAutocryptReader(now.Add(-time.Hour), "addr=john.doe@example.org; prefer-encrypt=mutual; keydata="+keydata)
+	if err := UpdateAutocrypt(store, r, now); err != nil {
+		t.Fatalf("UpdateAutocrypt() = %v", err)
+	}
+
+	// Older messages must not override the state
+	r = testAutocryptReader(now.Add(-2*time.Hour), "")
+	if err := UpdateAutocrypt(store, r, now); err != nil {
+		t.Fatalf("UpdateAutocrypt() = %v", err)
+	}
+
+	peer, err := store.Peer("John.Doe@example.org")
+	if err != nil {
+		t.Fatalf("Peer() = %v", err)
+	}
+	if peer == nil {
+		t.Fatalf("Peer() = nil")
+	}
+	if !peer.AutocryptTimestamp.Equal(now.Add(-time.Hour)) {
+		t.Errorf("AutocryptPeer.AutocryptTimestamp = %v", peer.AutocryptTimestamp)
+	}
+	if !peer.LastSeen.Equal(now.Add(-time.Hour)) {
+		t.Errorf("AutocryptPeer.LastSeen = %v", peer.LastSeen)
+	}
+	if peer.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("AutocryptPeer.PreferEncrypt = %q", peer.PreferEncrypt)
+	}
+	if peer.PublicKey == nil {
+		t.Errorf("AutocryptPeer.PublicKey = nil")
+	}
+
+	// Newer message without an Autocrypt header field
+	r = testAutocryptReader(now.Add(time.Hour), "")
+	if err := UpdateAutocrypt(store, r, now); err != nil {
+		t.Fatalf("UpdateAutocrypt() = %v", err)
+	}
+	peer, _ = store.Peer("john.doe@example.org")
+	if !peer.LastSeen.Equal(now) {
+		t.Errorf("AutocryptPeer.LastSeen = %v, want %v", peer.LastSeen, now)
+	}
+	if !peer.AutocryptTimestamp.Equal(now.Add(-time.Hour)) {
+		t.Errorf("AutocryptPeer.AutocryptTimestamp = %v", peer.AutocryptTimestamp)
+	}
+}
+
+func TestUpdateAutocrypt_gossip(t *testing.T) {
+	store := NewMemoryAutocryptStore()
+	now := time.Now()
+
+	r := testAutocryptReader(now, "")
+	r.AutocryptGossip = []*Autocrypt{{Addr: "jane@example.org", Key: testPublicKey}}
+	r.MessageDetails.IsSigned = true
+	r.MessageDetails.SignatureError = errTestAutocrypt
+	if err := UpdateAutocrypt(store, r, now); err != nil {
+		t.Fatalf("UpdateAutocrypt() = %v", err)
+	}
+	if peer, _ := store.Peer("jane@example.org"); peer != nil {
+		t.Errorf("Gossip with an invalid signature was processed")
+	}
+
+	r.MessageDetails.SignatureError = nil
+	if err := UpdateAutocrypt(store, r, now); err != nil {
+		t.Fatalf("UpdateAutocrypt() = %v", err)
+	}
+	peer, _ := store.Peer("jane@example.org")
+	if peer == nil || peer.GossipKey == nil {
+		t.Fatalf("Gossip key wasn't stored")
+	}
+
+	rec, keys, err := RecommendAutocrypt(store, []string{"jane@example.org"}, PreferEncryptMutual, false, now)
+	if err != nil {
+		t.Fatalf("RecommendAutocrypt() = %v", err)
+	}
+	if rec != RecommendDiscourage || len(keys) != 1 {
+		t.Errorf("RecommendAutocrypt() = %v, %v, want %v", rec, keys, RecommendDiscourage)
+	}
+}
+
+var errTestAutocrypt = errors.New("test error")
+
+func TestRecommendAutocrypt(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryAutocryptStore()
+	store.SetPeer(&AutocryptPeer{
+		Addr:               "mutual@example.org",
+		LastSeen:           now,
+		AutocryptTimestamp: now,
+		PublicKey:          testPublicKey,
+		PreferEncrypt:      PreferEncryptMutual,
+	})
+	store.SetPeer(&AutocryptPeer{
+		Addr:               "nopreference@example.org",
+		LastSeen:           now,
+		AutocryptTimestamp: now,
+		PublicKey:          testPublicKey,
+		PreferEncrypt:      PreferEncryptNoPreference,
+	})
+	store.SetPeer(&AutocryptPeer{
+		Addr:               "stale@example.org",
+		LastSeen:           now,
+		AutocryptTimestamp: now.Add(-40 * 24 * time.Hour),
+		PublicKey:          testPublicKey,
+		PreferEncrypt:      PreferEncryptMutual,
+	})
+
+	tests := []struct {
+		recipients       []string
+		preferEncrypt    PreferEncrypt
+		replyToEncrypted bool
+		want             Recommendation
+	}{
+		{[]string{"mutual@example.org"}, PreferEncryptMutual, false, RecommendEncrypt},
+		{[]string{"mutual@example.org"}, PreferEncryptNoPreference, false, RecommendAvailable},
+		{[]string{"mutual@example.org", "nopreference@example.org"}, PreferEncryptMutual, false, RecommendAvailable},
+		{[]string{"mutual@example.org", "stale@example.org"}, PreferEncryptMutual, false, RecommendDiscourage},
+		{[]string{"stale@example.org"}, PreferEncryptMutual, true, RecommendEncrypt},
+		{[]string{"mutual@example.org", "unknown@example.org"}, PreferEncryptMutual, false, RecommendDisable},
+		{nil, PreferEncryptMutual, false, RecommendDisable},
+	}
+	for _, tc := range tests {
+		rec, _, err := RecommendAutocrypt(store, tc.recipients, tc.preferEncrypt, tc.replyToEncrypted, now)
+		if err != nil {
+			t.Fatalf("RecommendAutocrypt(%v) = %v", tc.recipients, err)
+		}
+		if rec != tc.want {
+			t.Errorf("RecommendAutocrypt(%v, %v, %v) = %v, want %v", tc.recipients, tc.preferEncrypt, tc.replyToEncrypted, rec, tc.want)
+		}
+	}
+}
+
+func TestFileAutocryptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autocrypt.json")
+	now := time.Now().Truncate(time.Second)
+
+	store, err := OpenFileAutocryptStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileAutocryptStore() = %v", err)
+	}
+	err = store.SetPeer(&AutocryptPeer{
+		Addr:               "john.doe@example.org",
+		LastSeen:           now,
+		AutocryptTimestamp: now,
+		PublicKey:          testPublicKey,
+		PreferEncrypt:      PreferEncryptMutual,
+	})
+	if err != nil {
+		t.Fatalf("SetPeer() = %v", err)
+	}
+
+	store, err = OpenFileAutocryptStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileAutocryptStore() = %v", err)
+	}
+	peer, err := store.Peer("John.Doe@example.org")
+	if err != nil {
+		t.Fatalf("Peer() = %v", err)
+	}
+	if peer == nil {
+		t.Fatalf("Peer() = nil")
+	}
+	if !peer.LastSeen.Equal(now) || !peer.AutocryptTimestamp.Equal(now) {
+		t.Errorf("AutocryptPeer timestamps = %v, %v, want %v", peer.LastSeen, peer.AutocryptTimestamp, now)
+	}
+	if peer.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("AutocryptPeer.PreferEncrypt = %q", peer.PreferEncrypt)
+	}
+	if peer.PublicKey == nil || peer.PublicKey.PrimaryKey.KeyId != testPublicKey.PrimaryKey.KeyId {
+		t.Errorf("AutocryptPeer.PublicKey doesn't match test key")
+	}
+	if peer.GossipKey != nil {
+		t.Errorf("AutocryptPeer.GossipKey = %v, want nil", peer.GossipKey)
+	}
+}
@@ -0,0 +1,298 @@
+package pgpmail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/text/transform"
+)
+
+// See Autocrypt Level 1 section 4.4.
+
+const autocryptSetupDescription = `This message contains all information to transfer your Autocrypt
+settings along with your secret key securely from your original
+device.
+
+To set up your new device for Autocrypt, please follow the
+instructions that should be presented by your new device.
+
+You can keep this message and use it as a backup for your secret
+key. If you want to do this, you should write down the Setup Code
+and store it securely.
+`
+
+const (
+	autocryptSetupCodeLen   = 36
+	autocryptSetupCodeGroup = 4
+)
+
+// generateAutocryptSetupCode generates a random setup code made of nine
+// groups of four digits.
+func generateAutocryptSetupCode(config *packet.Config) (string, error) {
+	digits := make([]byte, 0, autocryptSetupCodeLen)
+	var buf [autocryptSetupCodeLen]byte
+	for len(digits) < autocryptSetupCodeLen {
+		if _, err := io.ReadFull(config.Random(), buf[:]); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Reject values which would bias the distribution
+			if b >= 250 || len(digits) == autocryptSetupCodeLen {
+				continue
+			}
+			digits = append(digits, '0'+b%10)
+		}
+	}
+	return formatAutocryptSetupCode(string(digits)), nil
+}
+
+func formatAutocryptSetupCode(digits string) string {
+	var groups []string
+	for i := 0; i < len(digits); i += autocryptSetupCodeGroup {
+		groups = append(groups, digits[i:i+autocryptSetupCodeGroup])
+	}
+	return strings.Join(groups, "-")
+}
+
+// normalizeAutocryptSetupCode accepts a setup code typed by the user, with or
+// without separators, and formats it.
+func normalizeAutocryptSetupCode(code string) (string, error) {
+	var digits []byte
+	for _, c := range []byte(code) {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == '-' || c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			// Ignore separators
+		default:
+			return "", fmt.Errorf("pgpmail: invalid character %q in Autocrypt setup code", c)
+		}
+	}
+	if len(digits) != autocryptSetupCodeLen {
+		return "", fmt.Errorf("pgpmail: Autocrypt setup code has %v digits, want %v", len(digits), autocryptSetupCodeLen)
+	}
+	return formatAutocryptSetupCode(string(digits)), nil
+}
+
+// WriteAutocryptSetupMessage writes an Autocrypt Setup Message containing the
+// secret key e to w, and returns the setup code needed to import it.
+//
+// h should contain the From and To header fields, both set to the user's own
+// address. The Subject and Content-Type header fields are set by
+// WriteAutocryptSetupMessage.
+func WriteAutocryptSetupMessage(w io.Writer, h textproto.Header, e *openpgp.Entity, preferEncrypt PreferEncrypt, config *packet.Config) (setupCode string, err error) {
+	if e.PrivateKey == nil {
+		return "", fmt.Errorf("pgpmail: Autocrypt Setup Message requires a secret key")
+	}
+
+	setupCode, err = generateAutocryptSetupCode(config)
+	if err != nil {
+		return "", err
+	}
+
+	mw := textproto.NewMultipartWriter(w)
+
+	if forceBoundary != "" {
+		mw.SetBoundary(forceBoundary)
+	}
+
+	h.Set("Subject", "Autocrypt Setup Message")
+	h.Set("Autocrypt-Setup-Message", "v1")
+	h.Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+
+	if err := textproto.WriteHeader(w, h); err != nil {
+		return "", err
+	}
+
+	var descHeader textproto.Header
+	descHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	descWriter, err := mw.CreatePart(descHeader)
+	if err != nil {
+		return "", err
+	}
+	crlfWriter := transform.NewWriter(descWriter, &crlfTransformer{})
+	if _, err := io.WriteString(crlfWriter, autocryptSetupDescription); err != nil {
+		return "", err
+	}
+	if err := crlfWriter.Close(); err != nil {
+		return "", err
+	}
+
+	var setupHeader textproto.Header
+	setupHeader.Set("Content-Type", "application/autocrypt-setup")
+	setupHeader.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "autocrypt-setup-message.html"}))
+	setupWriter, err := mw.CreatePart(setupHeader)
+	if err != nil {
+		return "", err
+	}
+
+	// armor uses LF lines endings, but we need CRLF
+	crlfWriter = transform.NewWriter(setupWriter, &crlfTransformer{})
+
+	if _, err := io.WriteString(crlfWriter, "<html><body><p>\nThis is the Autocrypt Setup File used to transfer keys between clients.\n</p><pre>\n"); err != nil {
+		return "", err
+	}
+
+	armorWriter, err := armor.Encode(crlfWriter, "PGP MESSAGE", map[string]string{
+		"Passphrase-Format": "numeric9x4",
+		"Passphrase-Begin":  setupCode[:2],
+	})
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openpgp.SymmetricallyEncrypt(armorWriter, []byte(setupCode), nil, config)
+	if err != nil {
+		return "", err
+	}
+
+	keyHeaders := make(map[string]string)
+	if preferEncrypt == PreferEncryptMutual {
+		keyHeaders["Autocrypt-Prefer-Encrypt"] = string(PreferEncryptMutual)
+	}
+	keyWriter, err := armor.Encode(plaintext, openpgp.PrivateKeyType, keyHeaders)
+	if err != nil {
+		return "", err
+	}
+	if err := e.SerializePrivateWithoutSigning(keyWriter, config); err != nil {
+		return "", err
+	}
+
+	if err := (multiCloser{keyWriter, plaintext, armorWriter}).Close(); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(crlfWriter, "\n</pre></body></html>\n"); err != nil {
+		return "", err
+	}
+	if err := crlfWriter.Close(); err != nil {
+		return "", err
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return setupCode, nil
+}
+
+// ReadAutocryptSetupMessage reads an Autocrypt Setup Message and decrypts the
+// secret key it contains with the setup code.
+//
+// The returned Autocrypt contains the secret key and the address found in the
+// From header field.
+func ReadAutocryptSetupMessage(r io.Reader, setupCode string, config *packet.Config) (*Autocrypt, error) {
+	setupCode, err := normalizeAutocryptSetupCode(setupCode)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := h.Get("Autocrypt-Setup-Message"); !strings.EqualFold(v, "v1") {
+		return nil, fmt.Errorf("pgpmail: unsupported Autocrypt Setup Message version %q", v)
+	}
+
+	mh := mail.Header{Header: message.Header{Header: h}}
+	from, err := mh.AddressList("From")
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to parse From header field: %v", err)
+	}
+	if len(from) != 1 {
+		return nil, fmt.Errorf("pgpmail: Autocrypt Setup Message requires exactly one From address, got %v", len(from))
+	}
+
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(t, "multipart/mixed") {
+		return nil, fmt.Errorf("pgpmail: Autocrypt Setup Message has type %q, not multipart/mixed", t)
+	}
+
+	mr := textproto.NewMultipartReader(br, params["boundary"])
+	var setupPart io.Reader
+	for setupPart == nil {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("pgpmail: Autocrypt Setup Message doesn't contain an application/autocrypt-setup part")
+		} else if err != nil {
+			return nil, fmt.Errorf("pgpmail: failed to read part in Autocrypt Setup Message: %v", err)
+		}
+
+		t, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err == nil && strings.EqualFold(t, "application/autocrypt-setup") {
+			setupPart, err = decodeTransferEncoding(p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// armor.Decode skips the HTML before the armored block
+	block, err := armor.Decode(setupPart)
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to parse Autocrypt setup armored data: %v", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return nil, fmt.Errorf("pgpmail: Autocrypt setup armored data has type %q, not PGP MESSAGE", block.Type)
+	}
+
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || !symmetric {
+			return nil, fmt.Errorf("pgpmail: incorrect Autocrypt setup code")
+		}
+		prompted = true
+		return []byte(setupCode), nil
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, nil, prompt, config)
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to decrypt Autocrypt Setup Message: %v", err)
+	}
+
+	var keyBuf bytes.Buffer
+	if _, err := io.Copy(&keyBuf, md.UnverifiedBody); err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to decrypt Autocrypt Setup Message: %v", err)
+	}
+
+	keyBlock, err := armor.Decode(&keyBuf)
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to parse Autocrypt setup key: %v", err)
+	}
+	if keyBlock.Type != openpgp.PrivateKeyType {
+		return nil, fmt.Errorf("pgpmail: Autocrypt setup key has type %q, not %v", keyBlock.Type, openpgp.PrivateKeyType)
+	}
+
+	el, err := openpgp.ReadKeyRing(keyBlock.Body)
+	if err != nil {
+		return nil, fmt.Errorf("pgpmail: failed to read Autocrypt setup key: %v", err)
+	}
+	if len(el) != 1 || el[0].PrivateKey == nil {
+		return nil, fmt.Errorf("pgpmail: Autocrypt setup key must contain exactly one secret key")
+	}
+
+	preferEncrypt := PreferEncryptNoPreference
+	if PreferEncrypt(keyBlock.Header["Autocrypt-Prefer-Encrypt"]) == PreferEncryptMutual {
+		preferEncrypt = PreferEncryptMutual
+	}
+
+	return &Autocrypt{
+		Addr:          from[0].Address,
+		PreferEncrypt: preferEncrypt,
+		Key:           el[0],
+	}, nil
+}
@@ -0,0 +1,64 @@
+package pgpmail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestAutocryptSetupMessage(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	setupCode, err := WriteAutocryptSetupMessage(&buf, h, testPrivateKey, PreferEncryptMutual, testConfig)
+	if err != nil {
+		t.Fatalf("WriteAutocryptSetupMessage() = %v", err)
+	}
+	if len(setupCode) != 44 || strings.Count(setupCode, "-") != 8 {
+		t.Errorf("WriteAutocryptSetupMessage() returned invalid setup code %q", setupCode)
+	}
+
+	s := buf.String()
+	if !strings.Contains(s, "\r\nAutocrypt-Setup-Message: v1\r\n") || !strings.Contains(s, "\r\nContent-Type: application/autocrypt-setup\r\n") {
+		t.Errorf("WriteAutocryptSetupMessage() has invalid structure:\n%v", s)
+	}
+	if !strings.Contains(s, "\r\nPassphrase-Begin: "+setupCode[:2]+"\r\n") {
+		t.Errorf("WriteAutocryptSetupMessage() doesn't contain Passphrase-Begin header:\n%v", s)
+	}
+
+	// Users may type the setup code without separators
+	digits := strings.ReplaceAll(setupCode, "-", "")
+	ac, err := ReadAutocryptSetupMessage(strings.NewReader(s), digits, nil)
+	if err != nil {
+		t.Fatalf("ReadAutocryptSetupMessage() = %v", err)
+	}
+	if ac.Addr != "john.doe@example.org" {
+		t.Errorf("Autocrypt.Addr = %q", ac.Addr)
+	}
+	if ac.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("Autocrypt.PreferEncrypt = %q, want %q", ac.PreferEncrypt, PreferEncryptMutual)
+	}
+	if ac.Key.PrivateKey == nil || ac.Key.PrimaryKey.KeyId != testPrivateKey.PrimaryKey.KeyId {
+		t.Errorf("Autocrypt.Key doesn't match test key")
+	}
+}
+
+func TestAutocryptSetupMessage_wrongCode(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	if _, err := WriteAutocryptSetupMessage(&buf, h, testPrivateKey, PreferEncryptNoPreference, nil); err != nil {
+		t.Fatalf("WriteAutocryptSetupMessage() = %v", err)
+	}
+
+	wrongCode := strings.Repeat("1234-", 8) + "1234"
+	if _, err := ReadAutocryptSetupMessage(&buf, wrongCode, nil); err == nil {
+		t.Errorf("ReadAutocryptSetupMessage() with wrong setup code succeeded")
+	}
+}
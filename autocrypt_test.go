@@ -0,0 +1,387 @@
+package pgpmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message/textproto"
+)
+
+func testAutocryptKeyData() string {
+	var buf bytes.Buffer
+	if err := testPublicKey.Serialize(&buf); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestReadAutocrypt(t *testing.T) {
+	keydata := testAutocryptKeyData()
+
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("Autocrypt", "addr=John.Doe@example.org; prefer-encrypt=mutual; _foo=bar; keydata="+keydata)
+
+	ac, err := ReadAutocrypt(h, nil)
+	if err != nil {
+		t.Fatalf("ReadAutocrypt() = %v", err)
+	}
+	if ac.Addr != "John.Doe@example.org" {
+		t.Errorf("Autocrypt.Addr = %q", ac.Addr)
+	}
+	if ac.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("Autocrypt.PreferEncrypt = %q, want %q", ac.PreferEncrypt, PreferEncryptMutual)
+	}
+	if ac.Key == nil || ac.Key.PrimaryKey.KeyId != testPublicKey.PrimaryKey.KeyId {
+		t.Errorf("Autocrypt.Key doesn't match test key")
+	}
+}
+
+func TestReadAutocrypt_config(t *testing.T) {
+	expiring, err := openpgp.NewEntity("John Doe", "", "john.doe@example.org", &packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		Time:            testConfig.Time,
+		KeyLifetimeSecs: 3600,
+	})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := expiring.Serialize(&buf); err != nil {
+		t.Fatalf("Entity.Serialize() = %v", err)
+	}
+
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("Autocrypt", "addr=john.doe@example.org; keydata="+base64.StdEncoding.EncodeToString(buf.Bytes()))
+
+	if _, err := ReadAutocrypt(h, testConfig); err != nil {
+		t.Errorf("ReadAutocrypt() before expiration = %v", err)
+	}
+	later := &packet.Config{Time: func() time.Time { return testConfig.Now().Add(2 * time.Hour) }}
+	if ac, err := ReadAutocrypt(h, later); err == nil {
+		t.Errorf("ReadAutocrypt() after expiration = %v, want an error", ac)
+	}
+}
+
+func TestReadAutocrypt_none(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	ac, err := ReadAutocrypt(h, nil)
+	if ac != nil || err != nil {
+		t.Errorf("ReadAutocrypt() = %v, %v, want nil, nil", ac, err)
+	}
+}
+
+func TestReadAutocrypt_invalid(t *testing.T) {
+	keydata := testAutocryptKeyData()
+
+	tests := []struct {
+		name   string
+		fields []string
+	}{
+		{"addrMismatch", []string{"addr=someone.else@example.org; keydata=" + keydata}},
+		{"unknownCritical", []string{"addr=john.doe@example.org; foo=bar; keydata=" + keydata}},
+		{"missingKeyData", []string{"addr=john.doe@example.org"}},
+		{"invalidKeyData", []string{"addr=john.doe@example.org; keydata=Zm9v"}},
+		{"duplicate", []string{
+			"addr=john.doe@example.org; keydata=" + keydata,
+			"addr=john.doe@example.org; keydata=" + keydata,
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var h textproto.Header
+			h.Set("From", "John Doe <john.doe@example.org>")
+			for _, v := range tc.fields {
+				h.Add("Autocrypt", v)
+			}
+
+			if ac, err := ReadAutocrypt(h, nil); err == nil {
+				t.Errorf("ReadAutocrypt() = %v, want an error", ac)
+			}
+		})
+	}
+}
+
+func TestReader_autocryptGossip(t *testing.T) {
+	keydata := testAutocryptKeyData()
+
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+	encryptedHeader.Add("Autocrypt-Gossip", "addr=john.doe@example.org; keydata="+keydata)
+	encryptedHeader.Add("Autocrypt-Gossip", "addr=not.a.recipient@example.org; keydata="+keydata)
+
+	var buf bytes.Buffer
+	cleartext, err := Encrypt(&buf, h, []*openpgp.Entity{testPublicKey}, testPrivateKey, testConfig)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is an encrypted message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	if len(r.AutocryptGossip) != 1 {
+		t.Fatalf("Reader.AutocryptGossip = %v, want exactly one entry", r.AutocryptGossip)
+	}
+	if addr := r.AutocryptGossip[0].Addr; addr != "john.doe@example.org" {
+		t.Errorf("Reader.AutocryptGossip[0].Addr = %q", addr)
+	}
+}
+
+func TestReader_autocryptGossipSignedOnly(t *testing.T) {
+	r, err := Read(strings.NewReader(testPGPMIMESigned), openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if r.AutocryptGossip != nil {
+		t.Errorf("Reader.AutocryptGossip = %v, want nil", r.AutocryptGossip)
+	}
+}
+
+func checkAutocryptFolding(t *testing.T, s string) {
+	for _, l := range strings.Split(s, "\r\n") {
+		if len(l) > 78 {
+			t.Errorf("Line is longer than 78 characters: %q", l)
+		}
+	}
+}
+
+func TestSignWithOptions_autocrypt(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var signedHeader textproto.Header
+	signedHeader.Set("Content-Type", "text/plain")
+
+	var buf bytes.Buffer
+	cleartext, err := SignWithOptions(&buf, h, &WriteOptions{
+		Signer:        testPrivateKey,
+		Config:        testConfig,
+		Autocrypt:     true,
+		PreferEncrypt: PreferEncryptMutual,
+	})
+	if err != nil {
+		t.Fatalf("SignWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, signedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is a signed message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	checkAutocryptFolding(t, buf.String())
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	ac, err := ReadAutocrypt(r.Header, nil)
+	if err != nil {
+		t.Fatalf("ReadAutocrypt() = %v", err)
+	}
+	if ac == nil {
+		t.Fatalf("ReadAutocrypt() = nil")
+	}
+	if ac.Addr != "john.doe@example.org" {
+		t.Errorf("Autocrypt.Addr = %q", ac.Addr)
+	}
+	if ac.PreferEncrypt != PreferEncryptMutual {
+		t.Errorf("Autocrypt.PreferEncrypt = %q, want %q", ac.PreferEncrypt, PreferEncryptMutual)
+	}
+	if ac.Key.PrimaryKey.KeyId != testPublicKey.PrimaryKey.KeyId {
+		t.Errorf("Autocrypt.Key doesn't match test key")
+	}
+	if len(ac.Key.Subkeys) != 1 {
+		t.Errorf("Autocrypt.Key has %v subkeys, want 1", len(ac.Key.Subkeys))
+	}
+}
+
+func TestSignWithOptions_autocryptLongAddress(t *testing.T) {
+	addr := strings.Repeat("a", 60) + "@example.org"
+	signer := newTestEntity(t, "", addr)
+
+	var h textproto.Header
+	h.Set("From", addr)
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	for _, preferEncrypt := range []PreferEncrypt{PreferEncryptNoPreference, PreferEncryptMutual} {
+		var buf bytes.Buffer
+		cleartext, err := SignWithOptions(&buf, h, &WriteOptions{
+			Signer:        signer,
+			Config:        testConfig,
+			Autocrypt:     true,
+			PreferEncrypt: preferEncrypt,
+		})
+		if err != nil {
+			t.Fatalf("SignWithOptions() = %v", err)
+		}
+		if _, err := io.WriteString(cleartext, "Content-Type: text/plain\r\n\r\nHi!\r\n"); err != nil {
+			t.Fatalf("io.WriteString() = %v", err)
+		}
+		if err := cleartext.Close(); err != nil {
+			t.Fatalf("cleartext.Close() = %v", err)
+		}
+
+		checkAutocryptFolding(t, buf.String())
+
+		r, err := Read(&buf, openpgp.EntityList{signer}, nil, nil)
+		if err != nil {
+			t.Fatalf("Read() = %v", err)
+		}
+		ac, err := ReadAutocrypt(r.Header, testConfig)
+		if err != nil {
+			t.Fatalf("ReadAutocrypt() = %v", err)
+		}
+		if ac == nil || ac.Addr != addr || ac.PreferEncrypt != preferEncrypt {
+			t.Errorf("ReadAutocrypt() = %+v, want addr %q and prefer-encrypt %q", ac, addr, preferEncrypt)
+		}
+	}
+}
+
+func TestEncryptWithOptions_autocrypt(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>, Jane <jane@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	to := []*openpgp.Entity{testPublicKey, testPublicKey}
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, to, &WriteOptions{
+		Signer:        testPrivateKey,
+		Config:        testConfig,
+		Autocrypt:     true,
+		PreferEncrypt: PreferEncryptNoPreference,
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is an encrypted message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	checkAutocryptFolding(t, buf.String())
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+	if !r.MessageDetails.IsEncrypted {
+		t.Errorf("MessageDetails.IsEncrypted != true")
+	}
+	checkAutocryptFolding(t, string(b))
+
+	ac, err := ReadAutocrypt(r.Header, nil)
+	if err != nil {
+		t.Fatalf("ReadAutocrypt() = %v", err)
+	}
+	if ac == nil || ac.PreferEncrypt != PreferEncryptNoPreference {
+		t.Errorf("ReadAutocrypt() = %v, want nopreference header", ac)
+	}
+
+	if len(r.AutocryptGossip) != 2 {
+		t.Fatalf("Reader.AutocryptGossip has %v entries, want 2", len(r.AutocryptGossip))
+	}
+	for _, gossip := range r.AutocryptGossip {
+		if gossip.Addr != "john.doe@example.org" {
+			t.Errorf("Autocrypt-Gossip addr = %q", gossip.Addr)
+		}
+	}
+}
+
+func TestEncryptWithOptions_autocryptBcc(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	bcc := newTestEntity(t, "Secret", "secret@bcc.example")
+	to := []*openpgp.Entity{testPublicKey, bcc}
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, to, &WriteOptions{
+		Signer:    testPrivateKey,
+		Config:    testConfig,
+		Autocrypt: true,
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is an encrypted message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if s := string(b); strings.Contains(s, "secret@bcc.example") {
+		t.Errorf("Bcc recipient disclosed in encrypted message:\n%v", s)
+	}
+	if n := strings.Count(string(b), "Autocrypt-Gossip:"); n != 1 {
+		t.Errorf("encrypted message has %v Autocrypt-Gossip header fields, want 1", n)
+	}
+}
@@ -0,0 +1,387 @@
+package pgpmail
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/text/transform"
+)
+
+// openpgp.EncryptText can't encrypt the session key with passphrases or hide
+// the recipients, so the encryption is reimplemented in this file. The
+// algorithm negotiation and the packets written mirror openpgp.EncryptText in
+// go-crypto v0.0.0-20230923063757-afb1ddc0824c, and need to be kept in sync
+// when go-crypto is updated.
+
+// Algorithms which can be used to encrypt and sign a message, in order of
+// preference. These are the same as the ones used by openpgp.EncryptText.
+var (
+	encryptCiphers = []packet.CipherFunction{
+		packet.CipherAES256,
+		packet.CipherAES128,
+	}
+	encryptCipherSuites = []packet.CipherSuite{
+		{Cipher: packet.CipherAES256, Mode: packet.AEADModeGCM},
+		{Cipher: packet.CipherAES256, Mode: packet.AEADModeEAX},
+		{Cipher: packet.CipherAES256, Mode: packet.AEADModeOCB},
+		{Cipher: packet.CipherAES128, Mode: packet.AEADModeGCM},
+		{Cipher: packet.CipherAES128, Mode: packet.AEADModeEAX},
+		{Cipher: packet.CipherAES128, Mode: packet.AEADModeOCB},
+	}
+	encryptCompression = []packet.CompressionAlgo{
+		packet.CompressionNone,
+		packet.CompressionZIP,
+		packet.CompressionZLIB,
+	}
+	encryptHashes = []crypto.Hash{
+		crypto.SHA256,
+		crypto.SHA384,
+		crypto.SHA512,
+		crypto.SHA3_256,
+		crypto.SHA3_512,
+	}
+)
+
+func hasPreference(prefs []uint8, v uint8) bool {
+	for _, pref := range prefs {
+		if pref == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCipherSuitePreference(prefs [][2]uint8, suite packet.CipherSuite) bool {
+	for _, pref := range prefs {
+		if pref[0] == uint8(suite.Cipher) && pref[1] == uint8(suite.Mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateConfig returns a copy of config whose cipher, AEAD mode,
+// compression and hash algorithms are supported by all recipients. The algorithms are
+// chosen like openpgp.EncryptText does: the ones set in config are used if
+// possible, and AEAD is only used if all recipients support it.
+func negotiateConfig(to []*openpgp.Entity, config *packet.Config) *packet.Config {
+	ciphers := append([]packet.CipherFunction(nil), encryptCiphers...)
+	suites := append([]packet.CipherSuite(nil), encryptCipherSuites...)
+	compression := append([]packet.CompressionAlgo(nil), encryptCompression...)
+	hashes := append([]crypto.Hash(nil), encryptHashes...)
+	aead := config.AEAD() != nil
+
+	for _, e := range to {
+		ident := e.PrimaryIdentity()
+		if ident == nil || ident.SelfSignature == nil {
+			continue
+		}
+		sig := ident.SelfSignature
+		if !sig.SEIPDv2 {
+			aead = false
+		}
+
+		var i int
+		for _, c := range ciphers {
+			if hasPreference(sig.PreferredSymmetric, uint8(c)) {
+				ciphers[i] = c
+				i++
+			}
+		}
+		ciphers = ciphers[:i]
+
+		i = 0
+		for _, suite := range suites {
+			if hasCipherSuitePreference(sig.PreferredCipherSuites, suite) {
+				suites[i] = suite
+				i++
+			}
+		}
+		suites = suites[:i]
+
+		i = 0
+		for _, algo := range compression {
+			if hasPreference(sig.PreferredCompression, uint8(algo)) {
+				compression[i] = algo
+				i++
+			}
+		}
+		compression = compression[:i]
+
+		i = 0
+		for _, h := range hashes {
+			if id, ok := openpgp.HashToHashId(h); ok && hasPreference(sig.PreferredHash, id) {
+				hashes[i] = h
+				i++
+			}
+		}
+		hashes = hashes[:i]
+	}
+
+	// Fall back to the algorithms all implementations must support
+	if len(ciphers) == 0 {
+		ciphers = []packet.CipherFunction{packet.CipherAES128}
+	}
+	if len(suites) == 0 {
+		suites = []packet.CipherSuite{{Cipher: packet.CipherAES128, Mode: packet.AEADModeOCB}}
+	}
+	if len(hashes) == 0 {
+		hashes = []crypto.Hash{crypto.SHA256}
+	}
+
+	negotiated := &packet.Config{}
+	if config != nil {
+		*negotiated = *config
+	}
+
+	if aead {
+		suite := suites[0]
+		for _, s := range suites {
+			if s.Cipher == config.Cipher() && s.Mode == config.AEAD().Mode() {
+				suite = s
+				break
+			}
+		}
+		aeadConfig := *config.AEAD()
+		aeadConfig.DefaultMode = suite.Mode
+		negotiated.AEADConfig = &aeadConfig
+		negotiated.DefaultCipher = suite.Cipher
+	} else {
+		negotiated.AEADConfig = nil
+		negotiated.DefaultCipher = ciphers[0]
+		for _, c := range ciphers {
+			if c == config.Cipher() {
+				negotiated.DefaultCipher = c
+				break
+			}
+		}
+	}
+
+	// Unlike other algorithms, the hash must also be available here
+	negotiated.DefaultHash = 0
+	for _, h := range hashes {
+		if h.Available() {
+			negotiated.DefaultHash = h
+			break
+		}
+	}
+	for _, h := range hashes {
+		if h == config.Hash() && h.Available() {
+			negotiated.DefaultHash = h
+			break
+		}
+	}
+
+	negotiated.DefaultCompressionAlgo = packet.CompressionNone
+	for _, algo := range compression {
+		if algo == config.Compression() {
+			negotiated.DefaultCompressionAlgo = algo
+			break
+		}
+	}
+
+	return negotiated
+}
+
+// encryptionKeys returns the encryption key of each recipient.
+func encryptionKeys(to []*openpgp.Entity, now time.Time) ([]openpgp.Key, error) {
+	keys := make([]openpgp.Key, len(to))
+	for i, e := range to {
+		key, ok := e.EncryptionKey(now)
+		if !ok {
+			return nil, errorf(ErrMissingKey, "pgpmail: key %X has no valid encryption key", e.PrimaryKey.Fingerprint)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// encryptText is a wrapper for openpgp.EncryptText. Missing keys are reported
+// like encryptMessage does.
+func encryptText(ciphertext io.Writer, to []*openpgp.Entity, signed *openpgp.Entity, config *packet.Config) (io.WriteCloser, error) {
+	if len(to) == 0 {
+		return nil, errorf(ErrMissingKey, "pgpmail: no recipients")
+	}
+	if _, err := encryptionKeys(to, config.Now()); err != nil {
+		return nil, err
+	}
+	if signed != nil {
+		if _, ok := signed.SigningKeyById(config.Now(), config.SigningKey()); !ok {
+			return nil, errorf(ErrMissingKey, "pgpmail: key %X has no valid signing key", signed.PrimaryKey.Fingerprint)
+		}
+	}
+
+	plaintext, err := openpgp.EncryptText(ciphertext, to, signed, nil, config)
+	if err != nil {
+		return nil, errorf(pgpErrorKind(err), "pgpmail: failed to encrypt message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// encryptMessage is like openpgp.EncryptText, but also encrypts the session
+// key with the passphrases and hides the recipients if requested in options.
+func encryptMessage(ciphertext io.Writer, to []*openpgp.Entity, signed *openpgp.Entity, options *WriteOptions) (io.WriteCloser, error) {
+	if len(to) == 0 && len(options.Passphrases) == 0 {
+		return nil, errorf(ErrMissingKey, "pgpmail: no recipients")
+	}
+
+	config := negotiateConfig(to, options.Config)
+	cipherFunc := config.Cipher()
+	sessionKey := make([]byte, cipherFunc.KeySize())
+	if _, err := io.ReadFull(config.Random(), sessionKey); err != nil {
+		return nil, err
+	}
+
+	keys, err := encryptionKeys(to, config.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		pub := key.PublicKey
+		if options.HideRecipients {
+			// A zero key ID is a wildcard, see RFC 4880 section 5.1
+			hidden := *pub
+			hidden.KeyId = 0
+			pub = &hidden
+		}
+		if err := packet.SerializeEncryptedKey(ciphertext, pub, cipherFunc, sessionKey, config); err != nil {
+			return nil, err
+		}
+	}
+	for _, passphrase := range options.Passphrases {
+		if err := packet.SerializeSymmetricKeyEncryptedReuseKey(ciphertext, sessionKey, passphrase, config); err != nil {
+			return nil, err
+		}
+	}
+
+	cipherSuite := packet.CipherSuite{Cipher: cipherFunc}
+	if aead := config.AEAD(); aead != nil {
+		cipherSuite.Mode = aead.Mode()
+	}
+	payload, err := packet.SerializeSymmetricallyEncrypted(ciphertext, cipherFunc, config.AEAD() != nil, cipherSuite, sessionKey, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if algo := config.Compression(); algo != packet.CompressionNone {
+		payload, err = packet.SerializeCompressed(payload, algo, config.CompressionConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if signed != nil {
+		return newTextSigner(payload, signed, config)
+	}
+
+	literal, err := packet.SerializeLiteral(payload, false, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Text needs to be canonicalized, like openpgp.EncryptText does
+	crlfWriter := transform.NewWriter(literal, &crlfTransformer{})
+	return struct {
+		io.Writer
+		io.Closer
+	}{
+		crlfWriter,
+		multiCloser{crlfWriter, literal},
+	}, nil
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close method does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// textSigner writes a literal data packet signed with a text signature, like
+// openpgp.EncryptText does.
+type textSigner struct {
+	io.Writer
+	crlfWriter io.Closer
+	literal    io.Closer
+	payload    io.WriteCloser
+	pw         *io.PipeWriter
+	done       <-chan error
+	sigBuf     bytes.Buffer
+}
+
+func newTextSigner(payload io.WriteCloser, signed *openpgp.Entity, config *packet.Config) (*textSigner, error) {
+	key, ok := signed.SigningKeyById(config.Now(), config.SigningKey())
+	if !ok {
+		return nil, errorf(ErrMissingKey, "pgpmail: key %X has no valid signing key", signed.PrimaryKey.Fingerprint)
+	}
+
+	ops := &packet.OnePassSignature{
+		SigType:    packet.SigTypeText,
+		Hash:       config.Hash(),
+		PubKeyAlgo: key.PublicKey.PubKeyAlgo,
+		KeyId:      key.PublicKey.KeyId,
+		IsLast:     true,
+	}
+	if err := ops.Serialize(payload); err != nil {
+		return nil, err
+	}
+
+	// The signature packet is written after the literal data packet, so
+	// closing the literal data packet must not close payload
+	literal, err := packet.SerializeLiteral(nopWriteCloser{payload}, false, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	// Text needs to be canonicalized, like openpgp.EncryptText does
+	crlfWriter := transform.NewWriter(io.MultiWriter(pw, literal), &crlfTransformer{})
+
+	s := &textSigner{
+		Writer:     crlfWriter,
+		crlfWriter: crlfWriter,
+		literal:    literal,
+		payload:    payload,
+		pw:         pw,
+		done:       done,
+	}
+
+	go func() {
+		err := openpgp.DetachSignText(&s.sigBuf, signed, pr, config)
+		// Close the pipe to make sure writes don't block
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return s, nil
+}
+
+func (s *textSigner) Close() error {
+	if err := s.crlfWriter.Close(); err != nil {
+		return err
+	}
+	if err := s.literal.Close(); err != nil {
+		return err
+	}
+
+	// Close the pipe to let openpgp.DetachSignText finish
+	if err := s.pw.Close(); err != nil {
+		return err
+	}
+	if err := <-s.done; err != nil {
+		return err
+	}
+
+	if _, err := s.sigBuf.WriteTo(s.payload); err != nil {
+		return err
+	}
+	return s.payload.Close()
+}
@@ -0,0 +1,113 @@
+package pgpmail
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+)
+
+// Errors returned by this package wrap one of these errors, which can be
+// checked with errors.Is. The underlying go-crypto error, if any, can be
+// retrieved with errors.As.
+var (
+	// ErrMalformed indicates that the message structure is invalid.
+	ErrMalformed = errors.New("pgpmail: malformed message")
+	// ErrUnsupported indicates that the message uses an unsupported
+	// feature, e.g. an unknown PGP/MIME version or hash algorithm.
+	ErrUnsupported = errors.New("pgpmail: unsupported message")
+	// ErrMicalgMismatch indicates that the micalg parameter of a
+	// multipart/signed message doesn't match the signature.
+	ErrMicalgMismatch = errors.New("pgpmail: micalg mismatch")
+	// ErrBadSignature indicates that a signature is invalid.
+	ErrBadSignature = errors.New("pgpmail: bad signature")
+	// ErrMissingKey indicates that a message can't be written because a key
+	// is missing or has no valid signing or encryption subkey, or that a
+	// message can't be decrypted because the private key is missing. In the
+	// latter case, the error is a MissingKeyError.
+	ErrMissingKey = errors.New("pgpmail: missing key")
+	// ErrUnknownIssuer indicates that the key which issued a signature isn't
+	// in the keyring. It is the same error as the one returned by
+	// go-crypto.
+	ErrUnknownIssuer = pgperrors.ErrUnknownIssuer
+)
+
+// MissingKeyError is returned when a message can't be decrypted because
+// none of the private keys it is encrypted to is available. It matches
+// ErrMissingKey with errors.Is.
+type MissingKeyError struct {
+	// Recipients contains the keys the message is encrypted to.
+	Recipients []Recipient
+	Err        error
+}
+
+func (err *MissingKeyError) Error() string {
+	l := make([]string, len(err.Recipients))
+	for i, rcpt := range err.Recipients {
+		switch {
+		case rcpt.Hidden:
+			l[i] = "hidden recipient"
+		case rcpt.Fingerprint != nil:
+			l[i] = fmt.Sprintf("%X", rcpt.Fingerprint)
+		default:
+			l[i] = fmt.Sprintf("%016X", rcpt.KeyId)
+		}
+	}
+	return fmt.Sprintf("pgpmail: missing private key to decrypt message, encrypted to: %v", strings.Join(l, ", "))
+}
+
+func (err *MissingKeyError) Unwrap() error {
+	return err.Err
+}
+
+func (err *MissingKeyError) Is(target error) bool {
+	return target == ErrMissingKey
+}
+
+// kindError annotates an error with one of the sentinel errors.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (err *kindError) Error() string {
+	return err.err.Error()
+}
+
+func (err *kindError) Unwrap() error {
+	return errors.Unwrap(err.err)
+}
+
+func (err *kindError) Is(target error) bool {
+	return target == err.kind
+}
+
+// errorf formats an error like fmt.Errorf, and annotates it with kind. If
+// kind is nil, the error isn't annotated.
+func errorf(kind error, format string, v ...interface{}) error {
+	err := fmt.Errorf(format, v...)
+	if kind == nil {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// pgpErrorKind returns the sentinel error matching an error returned by
+// go-crypto, or nil.
+func pgpErrorKind(err error) error {
+	var (
+		structuralErr  pgperrors.StructuralError
+		unsupportedErr pgperrors.UnsupportedError
+		signatureErr   pgperrors.SignatureError
+	)
+	switch {
+	case errors.As(err, &structuralErr):
+		return ErrMalformed
+	case errors.As(err, &unsupportedErr):
+		return ErrUnsupported
+	case errors.As(err, &signatureErr):
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package pgpmail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestRead_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want error
+	}{
+		{"unsupported version", strings.Replace(testPGPMIMEEncryptedSigned, "\r\nVersion: 1\r\n", "\r\nVersion: 2\r\n", 1), ErrUnsupported},
+		{"wrong first part", strings.Replace(testPGPMIMEEncryptedSigned, "Content-Type: application/pgp-encrypted\r\n", "Content-Type: text/plain\r\n", 1), ErrMalformed},
+		{"unsupported micalg", strings.Replace(testPGPMIMESigned, "micalg=pgp-SHA256", "micalg=pgp-foo", 1), ErrUnsupported},
+	}
+	for _, tc := range tests {
+		_, err := Read(strings.NewReader(tc.msg), openpgp.EntityList{testPrivateKey}, nil, nil)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%v: pgpmail.Read() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestRead_missingKey(t *testing.T) {
+	_, err := Read(strings.NewReader(testPGPMIMEEncryptedSigned), openpgp.EntityList{testPublicKey}, nil, nil)
+
+	var missingKeyErr *MissingKeyError
+	if !errors.As(err, &missingKeyErr) {
+		t.Fatalf("pgpmail.Read() = %v, want a MissingKeyError", err)
+	}
+	want := testPublicKey.Subkeys[0].PublicKey
+	if len(missingKeyErr.Recipients) != 1 {
+		t.Fatalf("len(MissingKeyError.Recipients) = %v, want 1", len(missingKeyErr.Recipients))
+	}
+	rcpt := missingKeyErr.Recipients[0]
+	if rcpt.KeyId != want.KeyId || rcpt.Hidden {
+		t.Errorf("MissingKeyError.Recipients[0] = %X, hidden: %v, want %X", rcpt.KeyId, rcpt.Hidden, want.KeyId)
+	}
+	if !bytes.Equal(rcpt.Fingerprint, want.Fingerprint) {
+		t.Errorf("MissingKeyError.Recipients[0].Fingerprint = %X, want %X", rcpt.Fingerprint, want.Fingerprint)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("%X", want.Fingerprint)) {
+		t.Errorf("MissingKeyError.Error() = %q doesn't contain the fingerprint", err.Error())
+	}
+	if n := strings.Count(err.Error(), "pgpmail:"); n != 1 {
+		t.Errorf("pgpmail.Read() = %q, want a single pgpmail prefix", err.Error())
+	}
+	if !errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		t.Errorf("MissingKeyError doesn't wrap ErrKeyIncorrect")
+	}
+	if !errors.Is(err, ErrMissingKey) {
+		t.Errorf("MissingKeyError doesn't match ErrMissingKey")
+	}
+}
+
+func TestReader_signatureErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want error
+	}{
+		{"micalg mismatch", strings.Replace(testPGPMIMESigned, "micalg=pgp-SHA256", "micalg=pgp-sha512", 1), ErrMicalgMismatch},
+		{"bad signature", testPGPMIMESignedInvalid, ErrBadSignature},
+	}
+	for _, tc := range tests {
+		r, err := Read(strings.NewReader(tc.msg), openpgp.EntityList{testPrivateKey}, nil, nil)
+		if err != nil {
+			t.Fatalf("%v: pgpmail.Read() = %v", tc.name, err)
+		}
+		if err := r.Verify(); !errors.Is(err, tc.want) {
+			t.Errorf("%v: Reader.Verify() = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	msg := strings.Replace(testPGPMIMESigned, "micalg=pgp-SHA256", "micalg=pgp-sha512", 1)
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList(nil), nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if err := r.Verify(); !errors.Is(err, ErrMicalgMismatch) {
+		t.Errorf("Reader.Verify() with unknown issuer = %v, want ErrMicalgMismatch", err)
+	}
+
+	r, err = Read(strings.NewReader(testPGPMIMESignedInvalid), openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	var sigErr pgperrors.SignatureError
+	if err := r.Verify(); !errors.As(err, &sigErr) {
+		t.Errorf("Reader.Verify() = %v, doesn't wrap a go-crypto SignatureError", err)
+	}
+}
+
+func TestReader_Verify_readError(t *testing.T) {
+	r := &Reader{
+		MessageDetails: &openpgp.MessageDetails{
+			IsSigned:       true,
+			UnverifiedBody: iotest.ErrReader(pgperrors.StructuralError("truncated")),
+		},
+	}
+	err := r.Verify()
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("Reader.Verify() = %v, want ErrMalformed", err)
+	}
+	var structuralErr pgperrors.StructuralError
+	if !errors.As(err, &structuralErr) {
+		t.Errorf("Reader.Verify() = %v, doesn't wrap a StructuralError", err)
+	}
+}
+
+func TestWrite_errors(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	if _, err := SignWithOptions(ioutil.Discard, h, nil); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("SignWithOptions() without signer = %v, want ErrMissingKey", err)
+	}
+	if _, err := EncryptWithOptions(ioutil.Discard, h, nil, &WriteOptions{Encapsulate: true}); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() without signer = %v, want ErrMissingKey", err)
+	}
+	if _, err := EncryptWithOptions(ioutil.Discard, h, []*openpgp.Entity{testPublicKey}, &WriteOptions{Autocrypt: true}); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() with Autocrypt and without signer = %v, want ErrMissingKey", err)
+	}
+	if _, err := EncryptWithOptions(ioutil.Discard, h, nil, &WriteOptions{HideRecipients: true}); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() without recipients = %v, want ErrMissingKey", err)
+	}
+
+	expiring, err := openpgp.NewEntity("Jane", "", "jane@example.org", &packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		Time:            testConfig.Time,
+		KeyLifetimeSecs: 3600,
+	})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	config := &packet.Config{Time: func() time.Time { return testConfig.Now().Add(2 * time.Hour) }}
+	_, err = EncryptWithOptions(ioutil.Discard, h, []*openpgp.Entity{expiring}, &WriteOptions{
+		Config:      config,
+		Passphrases: [][]byte{[]byte("passphrase")},
+	})
+	if !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() with expired key = %v, want ErrMissingKey", err)
+	}
+	_, err = EncryptWithOptions(ioutil.Discard, h, []*openpgp.Entity{expiring}, &WriteOptions{Config: config})
+	if !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() with expired key and without passphrase = %v, want ErrMissingKey", err)
+	}
+	_, err = EncryptWithOptions(ioutil.Discard, h, []*openpgp.Entity{testPublicKey}, &WriteOptions{
+		Signer: expiring,
+		Config: config,
+	})
+	if !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() with expired signing key = %v, want ErrMissingKey", err)
+	}
+	if _, err := EncryptWithOptions(ioutil.Discard, h, nil, nil); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("EncryptWithOptions() without recipients and passphrase = %v, want ErrMissingKey", err)
+	}
+}
@@ -52,8 +52,8 @@ func ExampleEncrypt() {
 	var signer *openpgp.Entity
 
 	var mailHeader mail.Header
-	mailHeader.SetAddressList("From", []*mail.Address{{"Mitsuha Miyamizu", "mitsuha.miyamizu@example.org"}})
-	mailHeader.SetAddressList("To", []*mail.Address{{"Taki Tachibana", "taki.tachibana@example.org"}})
+	mailHeader.SetAddressList("From", []*mail.Address{{Name: "Mitsuha Miyamizu", Address: "mitsuha.miyamizu@example.org"}})
+	mailHeader.SetAddressList("To", []*mail.Address{{Name: "Taki Tachibana", Address: "taki.tachibana@example.org"}})
 
 	var encryptedHeader mail.Header
 	encryptedHeader.SetContentType("text/plain", nil)
@@ -91,8 +91,8 @@ func ExampleSign() {
 	var signer *openpgp.Entity
 
 	var mailHeader mail.Header
-	mailHeader.SetAddressList("From", []*mail.Address{{"Mitsuha Miyamizu", "mitsuha.miyamizu@example.org"}})
-	mailHeader.SetAddressList("To", []*mail.Address{{"Taki Tachibana", "taki.tachibana@example.org"}})
+	mailHeader.SetAddressList("From", []*mail.Address{{Name: "Mitsuha Miyamizu", Address: "mitsuha.miyamizu@example.org"}})
+	mailHeader.SetAddressList("To", []*mail.Address{{Name: "Taki Tachibana", Address: "taki.tachibana@example.org"}})
 
 	var signedHeader mail.Header
 	signedHeader.SetContentType("text/plain", nil)
@@ -6,5 +6,6 @@ require (
 	github.com/ProtonMail/go-crypto v0.0.0-20230923063757-afb1ddc0824c
 	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/emersion/go-message v0.17.0
+	golang.org/x/net v0.19.0
 	golang.org/x/text v0.14.0
 )
@@ -0,0 +1,248 @@
+package pgpmail
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/text/transform"
+)
+
+// Inline PGP messages carry ASCII-armored data directly in a text/plain body,
+// instead of using PGP/MIME.
+
+var (
+	armorSignedMessageBegin = []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+	armorMessageBegin       = []byte("-----BEGIN PGP MESSAGE-----")
+	armorMessageEnd         = []byte("-----END PGP MESSAGE-----")
+)
+
+// An InlineRange describes a region of an inline PGP message body.
+type InlineRange struct {
+	// Start and End are byte offsets into the body returned by
+	// MessageDetails.UnverifiedBody, after the header.
+	Start, End int
+	// IsEncrypted and IsSigned indicate whether the region was protected by
+	// the PGP block. Regions with both set to false were found outside of the
+	// PGP block.
+	IsEncrypted, IsSigned bool
+}
+
+// indexLine returns the index of the first line starting with prefix in b, or
+// -1.
+func indexLine(b, prefix []byte) int {
+	offset := 0
+	for {
+		i := bytes.Index(b[offset:], prefix)
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		if i == 0 || b[i-1] == '\n' {
+			return i
+		}
+		offset = i + len(prefix)
+	}
+}
+
+func newInlineReader(h textproto.Header, body io.Reader, options *ReadOptions) (*Reader, error) {
+	// Inline PGP data can appear anywhere in the body, so we need to buffer
+	// it. Keep the raw body around in case the message isn't inline PGP.
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := func() (*Reader, error) {
+		return newPlaintextReader(h, bytes.NewReader(raw)), nil
+	}
+
+	decoded, err := decodeTransferEncoding(h.Get("Content-Transfer-Encoding"), bytes.NewReader(raw))
+	if err != nil {
+		return plaintext()
+	}
+	b, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return plaintext()
+	}
+
+	// Only the first PGP block is processed, any text around it is returned
+	// as-is
+	signedStart := indexLine(b, armorSignedMessageBegin)
+	encryptedStart := indexLine(b, armorMessageBegin)
+
+	var (
+		start, end int
+		cleartext  []byte
+		md         *openpgp.MessageDetails
+		signatures []*SignatureResult
+		recipients []Recipient
+	)
+	switch {
+	case signedStart >= 0 && (encryptedStart < 0 || signedStart < encryptedStart):
+		block, rest := clearsign.Decode(b[signedStart:])
+		if block == nil {
+			return plaintext()
+		}
+		start, end = signedStart, len(b)-len(rest)
+		cleartext = block.Plaintext
+
+		md = &openpgp.MessageDetails{IsSigned: true}
+		signatures, md.SignatureError = verifyClearsignedBlock(md, options, messageDates(h), block)
+	case encryptedStart >= 0:
+		i := bytes.Index(b[encryptedStart:], armorMessageEnd)
+		if i < 0 {
+			return plaintext()
+		}
+		start, end = encryptedStart, encryptedStart+i+len(armorMessageEnd)
+		if i := bytes.IndexByte(b[end:], '\n'); i >= 0 {
+			end += i + 1
+		} else {
+			end = len(b)
+		}
+
+		block, err := armor.Decode(bytes.NewReader(b[start:end]))
+		if err != nil {
+			return plaintext()
+		}
+
+		md, recipients, err = readMessage(block.Body, options)
+		if err != nil {
+			// The PGP message might be quoted or intended for someone else,
+			// don't fail the whole message
+			r, _ := plaintext()
+			r.InlineError = err
+			return r, nil
+		}
+		// Reading the whole message checks the signature and integrity
+		cleartext, err = ioutil.ReadAll(&signatureCheckReader{
+			Reader:     md.UnverifiedBody,
+			md:         md,
+			options:    options,
+			dates:      messageDates(h),
+			signatures: &signatures,
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return plaintext()
+	}
+
+	// The whole body is canonicalized, not only the PGP block
+	before, _, err := transform.Bytes(&crlfTransformer{}, b[:start])
+	if err != nil {
+		return nil, err
+	}
+	cleartext, _, err = transform.Bytes(&crlfTransformer{}, cleartext)
+	if err != nil {
+		return nil, err
+	}
+	after, _, err := transform.Bytes(&crlfTransformer{}, b[end:])
+	if err != nil {
+		return nil, err
+	}
+
+	var cleartextBody bytes.Buffer
+	var ranges []InlineRange
+	appendRange := func(b []byte, encrypted, signed bool) {
+		if len(b) == 0 {
+			return
+		}
+		ranges = append(ranges, InlineRange{
+			Start:       cleartextBody.Len(),
+			End:         cleartextBody.Len() + len(b),
+			IsEncrypted: encrypted,
+			IsSigned:    signed,
+		})
+		cleartextBody.Write(b)
+	}
+	appendRange(before, false, false)
+	appendRange(cleartext, md.IsEncrypted, md.IsSigned)
+	appendRange(after, false, false)
+
+	var cleartextHeader textproto.Header
+	cleartextHeader.Set("Content-Type", h.Get("Content-Type"))
+
+	var headerBuf bytes.Buffer
+	textproto.WriteHeader(&headerBuf, cleartextHeader)
+	md.UnverifiedBody = io.MultiReader(&headerBuf, &cleartextBody)
+
+	return &Reader{
+		Header:         h,
+		MessageDetails: md,
+		InlineRanges:   ranges,
+		Signatures:     signatures,
+		Recipients:     recipients,
+	}, nil
+}
+
+func verifyClearsignedBlock(md *openpgp.MessageDetails, options *ReadOptions, dates []time.Time, block *clearsign.Block) ([]*SignatureResult, error) {
+	// See RFC 4880 section 7: if the Hash armor header is missing, MD5 is
+	// assumed
+	allowed := block.Headers.Values("Hash")
+	if len(allowed) == 0 {
+		allowed = []string{"MD5"}
+	}
+
+	return verifySignatures(md, options, dates, block.ArmoredSignature.Body, func(hashFunc crypto.Hash) (hash.Hash, error) {
+		ok := false
+		for _, name := range allowed {
+			if hashAlgs["pgp-"+strings.ToLower(name)] == hashFunc {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, errorf(ErrMalformed, "pgpmail: hash mismatch: armor header indicates %v but signature packet indicates %v", allowed, hashFunc)
+		}
+
+		if !hashFunc.Available() {
+			return nil, errorf(ErrUnsupported, "pgpmail: hash %v unavailable", hashFunc)
+		}
+		h := hashFunc.New()
+		h.Write(block.Bytes)
+		return h, nil
+	})
+}
+
+// decodeTransferEncoding decodes a body according to its
+// Content-Transfer-Encoding.
+func decodeTransferEncoding(enc string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(enc) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r), nil
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &whitespaceReplacingReader{r}), nil
+	case "7bit", "8bit", "binary", "":
+		return r, nil
+	default:
+		return nil, errorf(ErrUnsupported, "pgpmail: unhandled Content-Transfer-Encoding %q", enc)
+	}
+}
+
+// whitespaceReplacingReader replaces space and tab characters with a LF so
+// base64 bodies with a continuation indent can be decoded.
+type whitespaceReplacingReader struct {
+	r io.Reader
+}
+
+func (r *whitespaceReplacingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	for i := 0; i < n; i++ {
+		if b[i] == ' ' || b[i] == '\t' {
+			b[i] = '\n'
+		}
+	}
+	return n, err
+}
@@ -1,6 +1,7 @@
 // Package pgpmail implements PGP encryption for e-mail messages.
 //
-// PGP/MIME is defined in RFC 3156.
+// PGP/MIME is defined in RFC 3156. Inline PGP messages (text/plain bodies
+// containing ASCII-armored data) are also supported when reading.
 package pgpmail
 
 import (
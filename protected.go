@@ -0,0 +1,344 @@
+package pgpmail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Protected headers, also known as "Memory Hole", carry the real header fields
+// of a message in the header of the cleartext entity. The outer header
+// fields may contain placeholders, e.g. "..." as the Subject. See
+// draft-autocrypt-lamps-protected-headers.
+
+// RFC 9788 header protection is its successor: the Content-Type of the
+// cleartext entity has a hp parameter, and HP-Outer header fields record the
+// header fields exposed in the outer header.
+
+// HeaderProtection is a header protection scheme.
+type HeaderProtection string
+
+const (
+	HeaderProtectionNone HeaderProtection = ""
+	// HeaderProtectionLegacy is the protected-headers="v1" scheme.
+	HeaderProtectionLegacy HeaderProtection = "v1"
+	// HeaderProtectionCipher is used by RFC 9788 for encrypted messages.
+	HeaderProtectionCipher HeaderProtection = "cipher"
+	// HeaderProtectionClear is used by RFC 9788 for signed-only messages.
+	HeaderProtectionClear HeaderProtection = "clear"
+)
+
+// HCP is a header confidentiality policy, see RFC 9788 section 3.2. It
+// returns the value of a header field in the outer header of an encrypted
+// message, or false if the field should be omitted from the outer header.
+type HCP func(k, v string) (string, bool)
+
+// HCPNoConfidentiality exposes all header fields in the outer header.
+func HCPNoConfidentiality(k, v string) (string, bool) {
+	return v, true
+}
+
+// HCPBaseline obscures the Subject and omits the Keywords and Comments
+// header fields.
+func HCPBaseline(k, v string) (string, bool) {
+	switch strings.ToLower(k) {
+	case "subject":
+		return "[...]", true
+	case "keywords", "comments":
+		return "", false
+	}
+	return v, true
+}
+
+// isContentField returns true if k is a MIME header field describing the
+// entity itself rather than the message.
+func isContentField(k string) bool {
+	k = strings.ToLower(k)
+	return strings.HasPrefix(k, "content-") || k == "mime-version"
+}
+
+// protectedFields returns the message header fields of a cleartext entity
+// header.
+func protectedFields(h textproto.Header) textproto.Header {
+	var raws [][]byte
+	fields := h.Fields()
+	for fields.Next() {
+		if isContentField(fields.Key()) || strings.EqualFold(fields.Key(), "HP-Outer") {
+			continue
+		}
+		raw, err := fields.Raw()
+		if err != nil {
+			continue
+		}
+		raws = append(raws, raw)
+	}
+
+	// AddRaw prepends fields
+	var protected textproto.Header
+	for i := len(raws) - 1; i >= 0; i-- {
+		protected.AddRaw(raws[i])
+	}
+	return protected
+}
+
+// ReadProtectedHeader reads the header of the cleartext entity. If it
+// carries protected headers, they are stored in ProtectedHeader and the
+// legacy display part is stripped from the cleartext body.
+//
+// ReadProtectedHeader must be called before reading
+// MessageDetails.UnverifiedBody. Afterwards, MessageDetails.UnverifiedBody
+// still returns the whole cleartext entity.
+func (r *Reader) ReadProtectedHeader() error {
+	md := r.MessageDetails
+	if !md.IsEncrypted && !md.IsSigned {
+		return nil
+	}
+
+	br := bufio.NewReader(md.UnverifiedBody)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return errorf(ErrMalformed, "pgpmail: failed to read cleartext header: %w", err)
+	}
+
+	var body io.Reader = br
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil {
+		r.HeaderProtection = HeaderProtectionNone
+		switch hp := HeaderProtection(strings.ToLower(params["hp"])); {
+		case hp == HeaderProtectionCipher && !md.IsEncrypted:
+			// The header fields weren't confidential
+			r.HeaderProtection = HeaderProtectionClear
+		case hp == HeaderProtectionCipher || hp == HeaderProtectionClear:
+			r.HeaderProtection = hp
+		case params["protected-headers"] == "v1":
+			r.HeaderProtection = HeaderProtectionLegacy
+		}
+	}
+	if r.HeaderProtection != HeaderProtectionNone {
+		protected := protectedFields(h)
+		r.ProtectedHeader = &protected
+
+		if r.HeaderProtection == HeaderProtectionCipher {
+			exposed := exposedFields(h)
+			r.ExposedHeader = &exposed
+		}
+
+		if strings.EqualFold(t, "multipart/mixed") {
+			body, err = stripLegacyDisplay(br, params["boundary"])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var headerBuf bytes.Buffer
+	textproto.WriteHeader(&headerBuf, h)
+	md.UnverifiedBody = io.MultiReader(&headerBuf, body)
+	return nil
+}
+
+func isLegacyDisplayPart(h textproto.Header) bool {
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && strings.EqualFold(t, "text/rfc822-headers") && params["protected-headers"] == "v1"
+}
+
+// stripLegacyDisplay removes the legacy display part from the body of a
+// multipart/mixed entity. The legacy display part is a copy of the protected
+// headers for clients which don't support them.
+func stripLegacyDisplay(body io.Reader, boundary string) (io.Reader, error) {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errorf(pgpErrorKind(err), "pgpmail: failed to read cleartext body: %w", err)
+	}
+
+	mr := textproto.NewMultipartReader(bytes.NewReader(raw), boundary)
+	p, err := mr.NextPart()
+	if err != nil || !isLegacyDisplayPart(p.Header) {
+		return bytes.NewReader(raw), nil
+	}
+
+	var buf bytes.Buffer
+	mw := textproto.NewMultipartWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return bytes.NewReader(raw), nil
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return bytes.NewReader(raw), nil
+		}
+
+		w, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(w, p); err != nil {
+			return bytes.NewReader(raw), nil
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// MergedHeader returns the outer header, with fields overridden by the
+// protected header fields, if any.
+func (r *Reader) MergedHeader() textproto.Header {
+	merged := r.Header.Copy()
+	if r.ProtectedHeader == nil {
+		return merged
+	}
+
+	var raws [][]byte
+	fields := r.ProtectedHeader.Fields()
+	for fields.Next() {
+		merged.Del(fields.Key())
+		raw, err := fields.Raw()
+		if err != nil {
+			continue
+		}
+		raws = append(raws, raw)
+	}
+	for i := len(raws) - 1; i >= 0; i-- {
+		merged.AddRaw(raws[i])
+	}
+	return merged
+}
+
+// exposedFields parses the HP-Outer header fields of a cleartext entity
+// header.
+func exposedFields(h textproto.Header) textproto.Header {
+	values := h.Values("HP-Outer")
+
+	var exposed textproto.Header
+	for i := len(values) - 1; i >= 0; i-- {
+		kv := strings.SplitN(values[i], ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		exposed.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return exposed
+}
+
+// IsConfidential returns true if the protected header field k was omitted or
+// obscured in the outer header by the sender.
+func (r *Reader) IsConfidential(k string) bool {
+	if r.HeaderProtection != HeaderProtectionCipher || r.ProtectedHeader == nil || !r.ProtectedHeader.Has(k) {
+		return false
+	}
+
+	protected := r.ProtectedHeader.Values(k)
+	exposed := r.ExposedHeader.Values(k)
+	if len(protected) != len(exposed) {
+		return true
+	}
+	for i := range protected {
+		if protected[i] != exposed[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type headerProtectionField struct {
+	k, v string
+	raw  []byte
+}
+
+func (f *headerProtectionField) addTo(h *textproto.Header) {
+	if f.raw != nil {
+		h.AddRaw(f.raw)
+	} else {
+		h.Add(f.k, f.v)
+	}
+}
+
+// headerProtection builds the outer and cleartext headers of a message
+// protected as described in RFC 9788.
+type headerProtection struct {
+	mode      HeaderProtection
+	outer     textproto.Header
+	protected []headerProtectionField
+	hpOuter   []headerProtectionField
+}
+
+func newHeaderProtection(h textproto.Header, mode HeaderProtection, hcp HCP) *headerProtection {
+	hp := &headerProtection{mode: mode}
+
+	var outer []headerProtectionField
+	fields := h.Fields()
+	for fields.Next() {
+		k, v := fields.Key(), fields.Value()
+		f := headerProtectionField{k: k, v: v}
+		if raw, err := fields.Raw(); err == nil {
+			f.raw = raw
+		}
+
+		if strings.EqualFold(k, "MIME-Version") {
+			// The outer entity is a MIME message too
+			outer = append(outer, f)
+			continue
+		}
+		if isContentField(k) || strings.EqualFold(k, "HP-Outer") {
+			continue
+		}
+
+		hp.protected = append(hp.protected, f)
+
+		outerValue, ok := hcp(k, v)
+		if !ok {
+			continue
+		}
+		if outerValue == v {
+			outer = append(outer, f)
+		} else {
+			outer = append(outer, headerProtectionField{k: k, v: outerValue})
+		}
+		if mode == HeaderProtectionCipher {
+			hp.hpOuter = append(hp.hpOuter, headerProtectionField{k: "HP-Outer", v: k + ": " + outerValue})
+		}
+	}
+
+	// Add prepends fields
+	for i := len(outer) - 1; i >= 0; i-- {
+		outer[i].addTo(&hp.outer)
+	}
+	return hp
+}
+
+// protect adds the protected header fields to the header of the cleartext
+// entity.
+func (hp *headerProtection) protect(h *textproto.Header) error {
+	t, params := "text/plain", map[string]string{"charset": "us-ascii"}
+	if v := h.Get("Content-Type"); v != "" {
+		var err error
+		t, params, err = mime.ParseMediaType(v)
+		if err != nil {
+			return errorf(ErrMalformed, "pgpmail: failed to parse Content-Type: %w", err)
+		}
+	}
+	params["hp"] = string(hp.mode)
+	h.Set("Content-Type", mime.FormatMediaType(t, params))
+
+	h.Del("HP-Outer")
+	for _, f := range hp.protected {
+		h.Del(f.k)
+	}
+
+	for i := len(hp.hpOuter) - 1; i >= 0; i-- {
+		hp.hpOuter[i].addTo(h)
+	}
+	for i := len(hp.protected) - 1; i >= 0; i-- {
+		hp.protected[i].addTo(h)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package pgpmail
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message/textproto"
+)
+
+var testProtectedHeadersBody = toCRLF(`--bar
+Content-Type: text/rfc822-headers; protected-headers="v1"
+Content-Disposition: inline
+
+Subject: Secret subject
+
+--bar
+Content-Type: text/plain
+
+This is an encrypted message!
+--bar--
+`)
+
+var testProtectedHeadersWithoutLegacyDisplay = toCRLF(`--bar
+Content-Type: text/plain
+
+This is an encrypted message!
+--bar--
+`)
+
+func TestReader_protectedHeader(t *testing.T) {
+	var h textproto.Header
+	h.Set("Subject", "...")
+	h.Set("To", "John Doe <john.doe@example.org>")
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", `multipart/mixed; boundary="bar"; protected-headers="v1"`)
+	encryptedHeader.Set("Subject", "Secret subject")
+	encryptedHeader.Set("From", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	cleartext, err := Encrypt(&buf, h, []*openpgp.Entity{testPublicKey}, testPrivateKey, testConfig)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, testProtectedHeadersBody); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if err := r.ReadProtectedHeader(); err != nil {
+		t.Fatalf("Reader.ReadProtectedHeader() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	if r.ProtectedHeader == nil {
+		t.Fatalf("Reader.ProtectedHeader = nil")
+	}
+	if r.ProtectedHeader.Has("Content-Type") {
+		t.Errorf("Reader.ProtectedHeader contains Content-Type")
+	}
+	if s := r.ProtectedHeader.Get("Subject"); s != "Secret subject" {
+		t.Errorf("Reader.ProtectedHeader.Get(\"Subject\") = %q", s)
+	}
+
+	merged := r.MergedHeader()
+	if s := merged.Get("Subject"); s != "Secret subject" {
+		t.Errorf("Reader.MergedHeader().Get(\"Subject\") = %q", s)
+	}
+	if s := merged.Get("To"); s != "John Doe <john.doe@example.org>" {
+		t.Errorf("Reader.MergedHeader().Get(\"To\") = %q", s)
+	}
+	if s := r.Header.Get("Subject"); s != "..." {
+		t.Errorf("Reader.Header.Get(\"Subject\") = %q, outer header was modified", s)
+	}
+
+	want := formatMessage(encryptedHeader, testProtectedHeadersWithoutLegacyDisplay)
+	if s := string(b); s != want {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, want)
+	}
+	if strings.Contains(string(b), "text/rfc822-headers") {
+		t.Errorf("Legacy display part wasn't stripped")
+	}
+}
+
+func TestReader_protectedHeaderNone(t *testing.T) {
+	r, err := Read(strings.NewReader(testPGPMIMEEncryptedSigned), openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if err := r.ReadProtectedHeader(); err != nil {
+		t.Fatalf("Reader.ReadProtectedHeader() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if r.ProtectedHeader != nil {
+		t.Errorf("Reader.ProtectedHeader = %v, want nil", r.ProtectedHeader)
+	}
+	if s := string(b); s != testEncryptedBody {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testEncryptedBody)
+	}
+}
+
+func TestEncryptWithOptions_protectHeaders(t *testing.T) {
+	var h textproto.Header
+	h.Set("MIME-Version", "1.0")
+	h.Set("Keywords", "secret")
+	h.Set("Subject", "Secret subject")
+	h.Set("To", "John Doe <john.doe@example.org>")
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, []*openpgp.Entity{testPublicKey}, &WriteOptions{
+		Signer:         testPrivateKey,
+		Config:         testConfig,
+		ProtectHeaders: true,
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is an encrypted message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if err := r.ReadProtectedHeader(); err != nil {
+		t.Fatalf("Reader.ReadProtectedHeader() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	if s := r.Header.Get("Subject"); s != "[...]" {
+		t.Errorf("Outer Subject = %q, want %q", s, "[...]")
+	}
+	if r.Header.Has("Keywords") {
+		t.Errorf("Outer header contains Keywords")
+	}
+	if s := r.Header.Get("MIME-Version"); s != "1.0" {
+		t.Errorf("Outer MIME-Version = %q, want %q", s, "1.0")
+	}
+	if r.HeaderProtection != HeaderProtectionCipher {
+		t.Errorf("Reader.HeaderProtection = %q, want %q", r.HeaderProtection, HeaderProtectionCipher)
+	}
+	merged := r.MergedHeader()
+	if s := merged.Get("Subject"); s != "Secret subject" {
+		t.Errorf("Reader.MergedHeader().Get(\"Subject\") = %q", s)
+	}
+
+	for k, want := range map[string]bool{
+		"Subject":  true,
+		"Keywords": true,
+		"From":     false,
+		"To":       false,
+	} {
+		if got := r.IsConfidential(k); got != want {
+			t.Errorf("Reader.IsConfidential(%q) = %v, want %v", k, got, want)
+		}
+	}
+	if s := r.ExposedHeader.Get("Subject"); s != "[...]" {
+		t.Errorf("Reader.ExposedHeader.Get(\"Subject\") = %q", s)
+	}
+}
+
+func TestSignWithOptions_protectHeaders(t *testing.T) {
+	var h textproto.Header
+	h.Set("MIME-Version", "1.0")
+	h.Set("Subject", "Signed subject")
+	h.Set("To", "John Doe <john.doe@example.org>")
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	var signedHeader textproto.Header
+	signedHeader.Set("Content-Type", "text/plain")
+
+	var buf bytes.Buffer
+	cleartext, err := SignWithOptions(&buf, h, &WriteOptions{
+		Signer:         testPrivateKey,
+		Config:         testConfig,
+		ProtectHeaders: true,
+	})
+	if err != nil {
+		t.Fatalf("SignWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, signedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is a signed message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if err := r.ReadProtectedHeader(); err != nil {
+		t.Fatalf("Reader.ReadProtectedHeader() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	if r.HeaderProtection != HeaderProtectionClear {
+		t.Errorf("Reader.HeaderProtection = %q, want %q", r.HeaderProtection, HeaderProtectionClear)
+	}
+	if s := r.Header.Get("Subject"); s != "Signed subject" {
+		t.Errorf("Outer Subject = %q", s)
+	}
+	if s := r.Header.Get("MIME-Version"); s != "1.0" {
+		t.Errorf("Outer MIME-Version = %q, want %q", s, "1.0")
+	}
+	if s := r.ProtectedHeader.Get("Subject"); s != "Signed subject" {
+		t.Errorf("Reader.ProtectedHeader.Get(\"Subject\") = %q", s)
+	}
+	if r.IsConfidential("Subject") {
+		t.Errorf("Reader.IsConfidential(\"Subject\") = true")
+	}
+}
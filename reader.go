@@ -4,40 +4,236 @@ import (
 	"bufio"
 	"bytes"
 	"crypto"
+	"encoding"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"mime"
 	"strings"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/armor"
-	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/emersion/go-message/textproto"
+	"golang.org/x/text/transform"
 )
 
 type Reader struct {
 	Header         textproto.Header
 	MessageDetails *openpgp.MessageDetails
+
+	// InlineRanges is populated for inline PGP messages. It describes which
+	// parts of the body were protected.
+	InlineRanges []InlineRange
+	// InlineError is set if the body contains an inline PGP message which
+	// couldn't be decrypted, e.g. because it is encrypted to someone else.
+	// The body is then returned as-is.
+	InlineError error
+
+	// AutocryptGossip contains the Autocrypt-Gossip header fields found in
+	// the cleartext header of an encrypted message. Gossip is only
+	// authenticated if the encrypted message is also signed: check
+	// MessageDetails.SignatureError after reading the body before trusting
+	// it.
+	AutocryptGossip []*Autocrypt
+
+	// ProtectedHeader contains the header fields protected by the PGP layer.
+	// It is populated by ReadProtectedHeader, and is nil if the message
+	// doesn't use protected headers.
+	ProtectedHeader *textproto.Header
+	// HeaderProtection is the header protection scheme used by the message.
+	// It is populated by ReadProtectedHeader.
+	HeaderProtection HeaderProtection
+	// ExposedHeader contains the header fields the sender exposed in the
+	// outer header, as recorded in HP-Outer header fields. It is only
+	// populated for HeaderProtectionCipher.
+	ExposedHeader *textproto.Header
+
+	// Signatures contains the result of the verification of each signature.
+	// It is populated after the body has been read.
+	Signatures []*SignatureResult
+
+	// Recipients contains the recipients listed in an encrypted message.
+	Recipients []Recipient
+
+	// Layers contains a Reader for each PGP/MIME layer of the message, from
+	// the outermost to the innermost. The first layer is the Reader itself.
+	// The MessageDetails and Signatures of each layer only describe that
+	// layer, and are complete once the body has been read. The
+	// MessageDetails.UnverifiedBody of nested layers must not be read
+	// directly.
+	Layers []*Reader
+
+	config *packet.Config
+}
+
+// ReadOptions contains options for reading a message.
+type ReadOptions struct {
+	KeyRing openpgp.KeyRing
+	Prompt  openpgp.PromptFunction
+	Config  *packet.Config
+
+	// TryAllSigningKeys enables checking signatures which don't indicate
+	// their issuer against all signing keys of KeyRing. KeyRing must be an
+	// openpgp.EntityList.
+	TryAllSigningKeys bool
+
+	// MaxDateSkew enables checking signature creation times against the Date
+	// header fields of the message. Signatures created more than MaxDateSkew
+	// apart from the Date are reported with ErrDateSkew, and the signing key
+	// must also be valid at the Date.
+	MaxDateSkew time.Duration
+	// ReplayCache, if set, is used to report signatures which have already
+	// been seen with ErrReplay.
+	ReplayCache ReplayCache
+
+	// MaxDepth is the maximum number of PGP/MIME layers unwrapped inside the
+	// outermost one, e.g. for messages signed, then encrypted, then signed
+	// again. If zero, nested layers aren't unwrapped.
+	MaxDepth int
+
+	// SignaturePolicy, if set, is called for each signature which is
+	// otherwise valid. If it returns an error, the
+	// signature is reported as invalid with this error. It can be used to
+	// reject signatures made with weak hash algorithms, for instance.
+	SignaturePolicy func(res *SignatureResult) error
 }
 
+// NewReader reads a PGP/MIME or inline PGP message.
+//
+// text/plain bodies are read fully into memory to look for inline PGP data.
 func NewReader(h textproto.Header, body io.Reader, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Reader, error) {
+	return NewReaderWithOptions(h, body, &ReadOptions{
+		KeyRing: keyring,
+		Prompt:  prompt,
+		Config:  config,
+	})
+}
+
+// NewReaderWithOptions is like NewReader, but takes a ReadOptions.
+func NewReaderWithOptions(h textproto.Header, body io.Reader, options *ReadOptions) (*Reader, error) {
+	if options == nil {
+		options = &ReadOptions{}
+	}
+
 	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
 	if err != nil {
-		return nil, err
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse Content-Type: %w", err)
 	}
 
-	if strings.EqualFold(t, "multipart/encrypted") && strings.EqualFold(params["protocol"], "application/pgp-encrypted") {
-		mr := textproto.NewMultipartReader(body, params["boundary"])
-		return newEncryptedReader(h, mr, keyring, prompt, config)
+	var r *Reader
+	if isPGPMIME(t, params) {
+		r, err = newPGPMIMEReader(h, t, params, body, options)
+		if err != nil {
+			return nil, err
+		}
+		r, err = unwrapLayers(r, options)
+		if err != nil {
+			return nil, err
+		}
+		r.config = options.Config
+		return r, nil
+	} else if strings.EqualFold(t, "text/plain") {
+		r, err = newInlineReader(h, body, options)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r = newPlaintextReader(h, body)
 	}
-	if strings.EqualFold(t, "multipart/signed") && strings.EqualFold(params["protocol"], "application/pgp-signature") {
-		micalg := params["micalg"]
-		mr := textproto.NewMultipartReader(body, params["boundary"])
-		return newSignedReader(h, mr, micalg, keyring, prompt, config)
+	r.Layers = []*Reader{r}
+	r.config = options.Config
+	return r, nil
+}
+
+func isPGPMIME(t string, params map[string]string) bool {
+	switch strings.ToLower(t) {
+	case "multipart/encrypted":
+		return strings.EqualFold(params["protocol"], "application/pgp-encrypted")
+	case "multipart/signed":
+		return strings.EqualFold(params["protocol"], "application/pgp-signature")
+	}
+	return false
+}
+
+func newPGPMIMEReader(h textproto.Header, t string, params map[string]string, body io.Reader, options *ReadOptions) (*Reader, error) {
+	mr := textproto.NewMultipartReader(body, params["boundary"])
+	if strings.EqualFold(t, "multipart/encrypted") {
+		return newEncryptedReader(h, mr, options)
+	}
+	return newSignedReader(h, mr, params["micalg"], options)
+}
+
+// unwrapLayers reads the PGP/MIME layers nested in r, up to
+// options.MaxDepth. The body of r is replaced with the body of the innermost
+// layer.
+func unwrapLayers(r *Reader, options *ReadOptions) (*Reader, error) {
+	r.Layers = []*Reader{r}
+
+	var outer []io.Reader
+	body := r.MessageDetails.UnverifiedBody
+	for depth := 0; depth < options.MaxDepth; depth++ {
+		br := bufio.NewReader(body)
+		h, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, errorf(ErrMalformed, "pgpmail: failed to read nested header: %w", err)
+		}
+
+		var headerBuf bytes.Buffer
+		textproto.WriteHeader(&headerBuf, h)
+		body = io.MultiReader(&headerBuf, br)
+
+		t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+		if err != nil || !isPGPMIME(t, params) {
+			break
+		}
+
+		layer, err := newPGPMIMEReader(h, t, params, br, options)
+		if err != nil {
+			return nil, fmt.Errorf("pgpmail: failed to read nested layer: %w", err)
+		}
+		r.Layers = append(r.Layers, layer)
+		if r.AutocryptGossip == nil {
+			r.AutocryptGossip = layer.AutocryptGossip
+		}
+
+		outer = append(outer, br)
+		body = layer.MessageDetails.UnverifiedBody
+	}
+
+	if len(outer) > 0 {
+		body = &layeredReader{Reader: body, outer: outer}
+	}
+	r.MessageDetails.UnverifiedBody = body
+	return r, nil
+}
+
+// layeredReader reads the body of the innermost layer of a message. Once it
+// is consumed, the rest of the outer layers is read, so that their
+// signatures and integrity are checked.
+type layeredReader struct {
+	io.Reader
+	outer []io.Reader
+}
+
+func (r *layeredReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != io.EOF {
+		return n, err
 	}
 
+	for i := len(r.outer) - 1; i >= 0; i-- {
+		if _, err := io.Copy(ioutil.Discard, r.outer[i]); err != nil {
+			return n, err
+		}
+	}
+	r.outer = nil
+	return n, io.EOF
+}
+
+func newPlaintextReader(h textproto.Header, body io.Reader) *Reader {
 	var headerBuf bytes.Buffer
 	textproto.WriteHeader(&headerBuf, h)
 
@@ -46,223 +242,247 @@ func NewReader(h textproto.Header, body io.Reader, keyring openpgp.KeyRing, prom
 		MessageDetails: &openpgp.MessageDetails{
 			UnverifiedBody: io.MultiReader(&headerBuf, body),
 		},
-	}, nil
+	}
 }
 
 func Read(r io.Reader, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Reader, error) {
+	return ReadWithOptions(r, &ReadOptions{
+		KeyRing: keyring,
+		Prompt:  prompt,
+		Config:  config,
+	})
+}
+
+// ReadWithOptions is like Read, but takes a ReadOptions.
+func ReadWithOptions(r io.Reader, options *ReadOptions) (*Reader, error) {
 	br := bufio.NewReader(r)
 
 	h, err := textproto.ReadHeader(br)
 	if err != nil {
-		return nil, err
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read header: %w", err)
 	}
 
-	return NewReader(h, br, keyring, prompt, config)
+	return NewReaderWithOptions(h, br, options)
 }
 
-func newEncryptedReader(h textproto.Header, mr *textproto.MultipartReader, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Reader, error) {
+func newEncryptedReader(h textproto.Header, mr *textproto.MultipartReader, options *ReadOptions) (*Reader, error) {
 	p, err := mr.NextPart()
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to read first part in multipart/encrypted message: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read first part in multipart/encrypted message: %w", err)
 	}
 
 	t, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to parse Content-Type of first part in multipart/encrypted message: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse Content-Type of first part in multipart/encrypted message: %w", err)
 	}
 	if !strings.EqualFold(t, "application/pgp-encrypted") {
-		return nil, fmt.Errorf("pgpmail: first part in multipart/encrypted message has type %q, not application/pgp-encrypted", t)
+		return nil, errorf(ErrMalformed, "pgpmail: first part in multipart/encrypted message has type %q, not application/pgp-encrypted", t)
 	}
 
 	metadata, err := textproto.ReadHeader(bufio.NewReader(p))
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to parse application/pgp-encrypted part: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse application/pgp-encrypted part: %w", err)
 	}
 	if s := metadata.Get("Version"); s != "1" {
-		return nil, fmt.Errorf("pgpmail: unsupported PGP/MIME version: %q", s)
+		return nil, errorf(ErrUnsupported, "pgpmail: unsupported PGP/MIME version: %q", s)
 	}
 
 	p, err = mr.NextPart()
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to read second part in multipart/encrypted message: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read second part in multipart/encrypted message: %w", err)
 	}
 	t, _, err = mime.ParseMediaType(p.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to parse Content-Type of second part in multipart/encrypted message: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse Content-Type of second part in multipart/encrypted message: %w", err)
 	}
 	if !strings.EqualFold(t, "application/octet-stream") {
-		return nil, fmt.Errorf("pgpmail: second part in multipart/encrypted message has type %q, not application/octet-stream", t)
+		return nil, errorf(ErrMalformed, "pgpmail: second part in multipart/encrypted message has type %q, not application/octet-stream", t)
 	}
 
 	block, err := armor.Decode(p)
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to parse encrypted armored data: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse encrypted armored data: %w", err)
 	}
 
-	md, err := openpgp.ReadMessage(block.Body, keyring, prompt, config)
+	md, recipients, err := readMessage(block.Body, options)
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to read PGP message: %v", err)
+		return nil, err
 	}
 
 	cleartext := bufio.NewReader(md.UnverifiedBody)
 	cleartextHeader, err := textproto.ReadHeader(cleartext)
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to read encrypted header: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read encrypted header: %w", err)
 	}
 
 	t, params, err := mime.ParseMediaType(cleartextHeader.Get("Content-Type"))
 	if err != nil {
-		return nil, err
+		return nil, errorf(ErrMalformed, "pgpmail: failed to parse encrypted Content-Type: %w", err)
 	}
 
+	gossip := readAutocryptGossip(h, cleartextHeader, options.Config.Now())
+
 	if md.IsEncrypted && !md.IsSigned && strings.EqualFold(t, "multipart/signed") && strings.EqualFold(params["protocol"], "application/pgp-signature") {
 		// RFC 1847 encapsulation, see RFC 3156 section 6.1
 		micalg := params["micalg"]
 		mr := textproto.NewMultipartReader(cleartext, params["boundary"])
-		sr, err := newSignedReader(cleartextHeader, mr, micalg, keyring, prompt, config)
+		sr, err := newSignedReader(cleartextHeader, mr, micalg, options)
 		if err != nil {
-			return nil, fmt.Errorf("pgpmail: failed to read encapsulated multipart/signed message: %v", err)
+			return nil, fmt.Errorf("pgpmail: failed to read encapsulated multipart/signed message: %w", err)
 		}
+		// The multipart/signed header is part of the encrypted body, keep the
+		// message header
+		sr.Header = h
 		sr.MessageDetails.IsEncrypted = md.IsEncrypted
 		sr.MessageDetails.EncryptedToKeyIds = md.EncryptedToKeyIds
 		sr.MessageDetails.IsSymmetricallyEncrypted = md.IsSymmetricallyEncrypted
 		sr.MessageDetails.DecryptedWith = md.DecryptedWith
+		sr.AutocryptGossip = gossip
+		sr.Recipients = recipients
 		return sr, nil
 	}
 
+	r := &Reader{
+		Header:          h,
+		MessageDetails:  md,
+		AutocryptGossip: gossip,
+		Recipients:      recipients,
+	}
+
+	// The signature is checked once the body has been read
+	body := &signatureCheckReader{
+		Reader:     cleartext,
+		md:         md,
+		options:    options,
+		dates:      messageDates(h, cleartextHeader),
+		signatures: &r.Signatures,
+	}
+
 	var headerBuf bytes.Buffer
 	textproto.WriteHeader(&headerBuf, cleartextHeader)
-	md.UnverifiedBody = io.MultiReader(&headerBuf, cleartext)
+	md.UnverifiedBody = io.MultiReader(&headerBuf, body)
 
-	return &Reader{
-		Header:         h,
-		MessageDetails: md,
-	}, nil
+	return r, nil
 }
 
 type signedReader struct {
-	keyring   openpgp.KeyRing
+	options   *ReadOptions
+	header    textproto.Header
 	multipart *textproto.MultipartReader
 	signed    io.Reader
 	hashFunc  crypto.Hash
 	hash      hash.Hash
-	md        *openpgp.MessageDetails
+	// signedData contains the canonical signed data if the state of hash
+	// can't be copied
+	signedData *bytes.Buffer
+	// hashWriter converts line endings to CRLF before writing to hash
+	hashWriter io.WriteCloser
+	md         *openpgp.MessageDetails
+	reader     *Reader
+	checked    bool
 }
 
 func (r *signedReader) Read(b []byte) (int, error) {
+	if r.checked {
+		return 0, io.EOF
+	}
+
 	n, err := r.signed.Read(b)
-	r.hash.Write(b[:n])
+	r.hashWriter.Write(b[:n])
 	if err == io.EOF {
+		r.checked = true
 		r.md.SignatureError = r.check()
 	}
 	return n, err
 }
 
 func (r *signedReader) check() error {
+	if err := r.hashWriter.Close(); err != nil {
+		return err
+	}
+
 	part, err := r.multipart.NextPart()
 	if err != nil {
-		return fmt.Errorf("pgpmail: failed to read signature part of multipart/signed message: %v", err)
+		return errorf(ErrMalformed, "pgpmail: failed to read signature part of multipart/signed message: %w", err)
 	}
 
 	t, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 	if err != nil {
-		return fmt.Errorf("pgpmail: failed to parse Content-Type of signature part in multipart/encrypted message: %v", err)
+		return errorf(ErrMalformed, "pgpmail: failed to parse Content-Type of signature part in multipart/encrypted message: %w", err)
 	}
 	if !strings.EqualFold(t, "application/pgp-signature") {
-		return fmt.Errorf("pgpmail: signature part in multipart/encrypted message has type %q, not application/pgp-signature", t)
+		return errorf(ErrMalformed, "pgpmail: signature part in multipart/encrypted message has type %q, not application/pgp-signature", t)
 	}
 
 	block, err := armor.Decode(part)
 	if err != nil {
-		return fmt.Errorf("pgpmail: failed to read armored signature block: %v", err)
+		return errorf(ErrMalformed, "pgpmail: failed to read armored signature block: %w", err)
 	}
 
-	var p packet.Packet
-	var keys []openpgp.Key
-	var sigErr error
-	pr := packet.NewReader(block.Body)
-	for {
-		p, err = pr.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return fmt.Errorf("pgpmail: failed to read signature: %v", err)
-		}
-
-		sig, ok := p.(*packet.Signature)
-		if !ok {
-			return fmt.Errorf("pgpmail: non signature packet found")
-		}
-
-		if sig.IssuerKeyId == nil {
-			return fmt.Errorf("pgpmail: signature doesn't have an issuer")
-		}
-
-		issuerKeyId := *sig.IssuerKeyId
-		hashFunc := sig.Hash
-
-		r.md.SignedByKeyId = issuerKeyId
-
+	dates := messageDates(r.header, r.reader.Header)
+	r.reader.Signatures, err = verifySignatures(r.md, r.options, dates, block.Body, func(hashFunc crypto.Hash) (hash.Hash, error) {
 		if hashFunc != r.hashFunc {
-			return fmt.Errorf("pgpmail: micalg mismatch: multipart header indicates %v but signature packet indicates %v", r.hashFunc, hashFunc)
-		}
-
-		keys = r.keyring.KeysByIdUsage(issuerKeyId, packet.KeyFlagSign)
-		if len(keys) == 0 {
-			continue
+			return nil, errorf(ErrMicalgMismatch, "pgpmail: micalg mismatch: multipart header indicates %v but signature packet indicates %v", r.hashFunc, hashFunc)
 		}
-
-		for i, key := range keys {
-			sigErr := key.PublicKey.VerifySignature(r.hash, sig)
-			if sigErr == nil {
-				r.md.SignedBy = &keys[i]
-				return nil
-			}
+		if r.signedData != nil {
+			h := r.hashFunc.New()
+			h.Write(r.signedData.Bytes())
+			return h, nil
 		}
-	}
-
-	if sigErr != nil {
-		return sigErr
-	}
-	return pgperrors.ErrUnknownIssuer
+		return cloneHash(r.hashFunc, r.hash)
+	})
+	return err
 }
 
-func newSignedReader(h textproto.Header, mr *textproto.MultipartReader, micalg string, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Reader, error) {
+func newSignedReader(h textproto.Header, mr *textproto.MultipartReader, micalg string, options *ReadOptions) (*Reader, error) {
 	micalg = strings.ToLower(micalg)
 	hashFunc, ok := hashAlgs[micalg]
 	if !ok {
-		return nil, fmt.Errorf("pgpmail: unsupported micalg %q", micalg)
+		return nil, errorf(ErrUnsupported, "pgpmail: unsupported micalg %q", micalg)
 	}
 
 	if !hashFunc.Available() {
-		return nil, fmt.Errorf("pgpmail: micalg %q unavailable", micalg)
+		return nil, errorf(ErrUnsupported, "pgpmail: micalg %q unavailable", micalg)
 	}
 	hash := hashFunc.New()
 
+	// Each signature needs its own copy of the hash. If the hash state can't
+	// be copied, keep the signed data to hash it again.
+	var hashed io.Writer = hash
+	var signedData *bytes.Buffer
+	if _, ok := hash.(encoding.BinaryMarshaler); !ok {
+		signedData = new(bytes.Buffer)
+		hashed = io.MultiWriter(hash, signedData)
+	}
+
 	p, err := mr.NextPart()
 	if err != nil {
-		return nil, fmt.Errorf("pgpmail: failed to read signed part in multipart/signed message: %v", err)
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read signed part in multipart/signed message: %w", err)
 	}
 
 	var headerBuf bytes.Buffer
 	textproto.WriteHeader(&headerBuf, p.Header)
 
-	// TODO: convert line endings to CRLF
-
-	md := &openpgp.MessageDetails{IsSigned: true}
+	md := &openpgp.MessageDetails{IsSigned: true, SignatureError: ErrNotVerified}
 
+	// The signed data is hashed in its canonical form, with CRLF line
+	// endings, but messages are often stored with LF line endings
 	sr := &signedReader{
-		keyring:   keyring,
-		multipart: mr,
-		signed:    io.MultiReader(&headerBuf, p),
-		hashFunc:  hashFunc,
-		hash:      hash,
-		md:        md,
+		options:    options,
+		header:     p.Header,
+		multipart:  mr,
+		signed:     io.MultiReader(&headerBuf, p),
+		hashFunc:   hashFunc,
+		hash:       hash,
+		signedData: signedData,
+		hashWriter: transform.NewWriter(hashed, &crlfTransformer{}),
+		md:         md,
 	}
 	md.UnverifiedBody = sr
 
-	return &Reader{
+	sr.reader = &Reader{
 		Header:         h,
 		MessageDetails: md,
-	}, nil
+	}
+	return sr.reader, nil
 }
@@ -2,6 +2,7 @@ package pgpmail
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/emersion/go-message/textproto"
 )
 
 func checkSignature(t *testing.T, md *openpgp.MessageDetails) {
@@ -57,6 +59,13 @@ func TestReader_encryptedSignedPGPMIME(t *testing.T) {
 	if s := buf.String(); s != testEncryptedBody {
 		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testEncryptedBody)
 	}
+
+	want := testPrivateKey.Subkeys[0].PublicKey
+	if len(r.Recipients) != 1 || r.Recipients[0].KeyId != want.KeyId || r.Recipients[0].Hidden {
+		t.Errorf("Reader.Recipients = %v, want key %X", r.Recipients, want.KeyId)
+	} else if !bytes.Equal(r.Recipients[0].Fingerprint, want.Fingerprint) {
+		t.Errorf("Reader.Recipients[0].Fingerprint = %X, want %X", r.Recipients[0].Fingerprint, want.Fingerprint)
+	}
 }
 
 func TestReader_encryptedSignedEncapsulatedPGPMIME(t *testing.T) {
@@ -101,6 +110,40 @@ func TestReader_signedPGPMIME(t *testing.T) {
 	}
 }
 
+func TestReader_signedPGPMIMELineEndings(t *testing.T) {
+	lf := strings.ReplaceAll(testPGPMIMESigned, "\r\n", "\n")
+	tests := []struct {
+		name, msg, body string
+	}{
+		{"crlf", testPGPMIMESigned, testSignedBody},
+		// The header is re-formatted, but the body is returned as-is
+		{"lf", lf, strings.Replace(testSignedBody, "message!\r\n", "message!\n", 1)},
+		{
+			"mixed",
+			strings.Replace(testPGPMIMESigned, "message!\r\n", "message!\n", 1),
+			strings.Replace(testSignedBody, "message!\r\n", "message!\n", 1),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := Read(strings.NewReader(tc.msg), openpgp.EntityList{testPublicKey}, nil, nil)
+			if err != nil {
+				t.Fatalf("pgpmail.Read() = %v", err)
+			}
+
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, r.MessageDetails.UnverifiedBody); err != nil {
+				t.Fatalf("io.Copy() = %v", err)
+			}
+
+			checkSignature(t, r.MessageDetails)
+			if s := buf.String(); s != tc.body {
+				t.Errorf("MessagesDetails.UnverifiedBody = %q but want %q", s, tc.body)
+			}
+		})
+	}
+}
+
 func TestReader_signedPGPMIMEInvalid(t *testing.T) {
 	sr := strings.NewReader(testPGPMIMESignedInvalid)
 	r, err := Read(sr, openpgp.EntityList{testPrivateKey}, nil, nil)
@@ -133,6 +176,140 @@ func TestReader_signedPGPMIMEUnknownIssuer(t *testing.T) {
 	}
 }
 
+func TestReader_inlineSigned(t *testing.T) {
+	sr := strings.NewReader(testInlineSigned)
+	r, err := Read(sr, openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+
+	if r.MessageDetails.IsEncrypted {
+		t.Errorf("MessageDetails.IsEncrypted != false")
+	}
+	checkSignature(t, r.MessageDetails)
+
+	if s := buf.String(); s != testInlineSignedBody {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testInlineSignedBody)
+	}
+}
+
+func TestReader_inlineSignedLF(t *testing.T) {
+	msg := strings.Replace(testInlineSigned, "-----BEGIN PGP SIGNED MESSAGE-----", "Hello!\r\n\r\n-----BEGIN PGP SIGNED MESSAGE-----", 1)
+	msg = strings.ReplaceAll(msg+"Footer\r\n", "\r\n", "\n")
+
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+
+	want := toCRLF("Content-Type: text/plain\n\nHello!\n\nThis is a clearsigned message!\n- dash line\nFooter\n")
+	if s := buf.String(); s != want {
+		t.Errorf("MessagesDetails.UnverifiedBody = %q, want %q", s, want)
+	}
+}
+
+func TestReader_inlineSignedInvalid(t *testing.T) {
+	s := strings.Replace(testInlineSigned, "clearsigned", "tampered", 1)
+	r, err := Read(strings.NewReader(s), openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+
+	if !r.MessageDetails.IsSigned {
+		t.Errorf("MessageDetails.IsSigned != true")
+	}
+	if err := r.MessageDetails.SignatureError; err == nil {
+		t.Errorf("MessageDetails.SignatureError = nil")
+	}
+}
+
+func TestReader_inlineSignedQuotedPrintable(t *testing.T) {
+	sr := strings.NewReader(testInlineSignedQuotedPrintable)
+	r, err := Read(sr, openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+
+	checkSignature(t, r.MessageDetails)
+}
+
+func TestReader_inlineEncrypted(t *testing.T) {
+	sr := strings.NewReader(testInlineEncrypted)
+	r, err := Read(sr, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+
+	checkSignature(t, r.MessageDetails)
+	checkEncryption(t, r.MessageDetails)
+
+	if s := buf.String(); s != testInlineEncryptedBody {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testInlineEncryptedBody)
+	}
+
+	want := []InlineRange{
+		{Start: 0, End: 8},
+		{Start: 8, End: 46, IsEncrypted: true, IsSigned: true},
+		{Start: 46, End: 59},
+	}
+	if len(r.InlineRanges) != len(want) {
+		t.Fatalf("Reader.InlineRanges = %+v, want %+v", r.InlineRanges, want)
+	}
+	for i := range want {
+		if r.InlineRanges[i] != want[i] {
+			t.Errorf("Reader.InlineRanges[%v] = %+v, want %+v", i, r.InlineRanges[i], want[i])
+		}
+	}
+}
+
+func TestReader_inlineEncryptedMissingKey(t *testing.T) {
+	sr := strings.NewReader(testInlineEncrypted)
+	r, err := Read(sr, openpgp.EntityList(nil), nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+
+	var missingKeyErr *MissingKeyError
+	if !errors.As(r.InlineError, &missingKeyErr) {
+		t.Errorf("Reader.InlineError = %v, want a MissingKeyError", r.InlineError)
+	}
+	if r.MessageDetails.IsEncrypted || r.InlineRanges != nil {
+		t.Errorf("Reader = %+v, want a plaintext reader", r)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	if !strings.Contains(buf.String(), "-----BEGIN PGP MESSAGE-----") {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want the raw body", buf.String())
+	}
+}
+
 func TestReader_plaintext(t *testing.T) {
 	sr := strings.NewReader(testPlaintext)
 	r, err := Read(sr, openpgp.EntityList(nil), nil, nil)
@@ -157,6 +334,125 @@ func TestReader_plaintext(t *testing.T) {
 	}
 }
 
+func TestReader_Verify(t *testing.T) {
+	for _, msg := range []string{testPGPMIMESigned, testPGPMIMEEncryptedSigned} {
+		r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPrivateKey}, nil, nil)
+		if err != nil {
+			t.Fatalf("pgpmail.Read() = %v", err)
+		}
+		if err := r.MessageDetails.SignatureError; err != ErrNotVerified {
+			t.Errorf("MessageDetails.SignatureError = %v before reading the body, want ErrNotVerified", err)
+		}
+		if err := r.Verify(); err != nil {
+			t.Errorf("Reader.Verify() = %v", err)
+		}
+		checkSignature(t, r.MessageDetails)
+	}
+
+	r, err := Read(strings.NewReader(testPlaintext), openpgp.EntityList(nil), nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if err := r.Verify(); err != ErrNotSigned {
+		t.Errorf("Reader.Verify() = %v, want ErrNotSigned", err)
+	}
+}
+
+// tripleWrap signs body, encrypts and signs the result, then signs it again.
+func tripleWrap(t *testing.T, body string) string {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	// Nested layers need distinct boundaries
+	defer func(boundary string) {
+		forceBoundary = boundary
+	}(forceBoundary)
+
+	wrap := func(w io.WriteCloser, err error, b []byte) {
+		if err != nil {
+			t.Fatalf("failed to create writer: %v", err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+	}
+
+	var signed, encrypted, outer bytes.Buffer
+	forceBoundary = "inner"
+	w, err := Sign(&signed, h, testPrivateKey, testConfig)
+	wrap(w, err, []byte(body))
+	forceBoundary = "encrypted"
+	w, err = Encrypt(&encrypted, h, []*openpgp.Entity{testPublicKey}, testPrivateKey, testConfig)
+	wrap(w, err, signed.Bytes())
+	forceBoundary = "outer"
+	w, err = Sign(&outer, h, testPrivateKey, testConfig)
+	wrap(w, err, encrypted.Bytes())
+	return outer.String()
+}
+
+func TestReader_nested(t *testing.T) {
+	msg := tripleWrap(t, testSignedBody)
+
+	r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+		KeyRing:  openpgp.EntityList{testPrivateKey},
+		MaxDepth: 8,
+	})
+	if err != nil {
+		t.Fatalf("pgpmail.ReadWithOptions() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if s := string(b); s != testSignedBody {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testSignedBody)
+	}
+
+	if len(r.Layers) != 3 {
+		t.Fatalf("len(Reader.Layers) = %v, want 3", len(r.Layers))
+	}
+	if r.Layers[0] != r {
+		t.Errorf("Reader.Layers[0] isn't the Reader itself")
+	}
+	for i, layer := range r.Layers {
+		checkSignature(t, layer.MessageDetails)
+		if want := i == 1; layer.MessageDetails.IsEncrypted != want {
+			t.Errorf("Reader.Layers[%v].MessageDetails.IsEncrypted = %v, want %v", i, layer.MessageDetails.IsEncrypted, want)
+		}
+	}
+	if len(r.Layers[2].Signatures) != 1 {
+		t.Errorf("len(Reader.Layers[2].Signatures) = %v, want 1", len(r.Layers[2].Signatures))
+	}
+}
+
+func TestReader_nestedMaxDepth(t *testing.T) {
+	msg := tripleWrap(t, testSignedBody)
+
+	r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+		KeyRing:  openpgp.EntityList{testPrivateKey},
+		MaxDepth: 1,
+	})
+	if err != nil {
+		t.Fatalf("pgpmail.ReadWithOptions() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if len(r.Layers) != 2 {
+		t.Fatalf("len(Reader.Layers) = %v, want 2", len(r.Layers))
+	}
+	if !strings.Contains(string(b), "multipart/signed") {
+		t.Errorf("MessagesDetails.UnverifiedBody doesn't contain the innermost layer")
+	}
+	checkSignature(t, r.MessageDetails)
+	checkSignature(t, r.Layers[1].MessageDetails)
+}
+
 var testEncryptedBody = toCRLF(`Content-Type: text/plain
 
 This is an encrypted message!
@@ -310,3 +606,93 @@ Content-Type: text/plain
 
 This is a plaintext message!
 `)
+
+var testInlineSignedBody = toCRLF(`Content-Type: text/plain
+
+This is a clearsigned message!
+- dash line
+`)
+
+var testInlineSigned = toCRLF(`From: John Doe <john.doe@example.org>
+To: John Doe <john.doe@example.org>
+Mime-Version: 1.0
+Content-Type: text/plain
+
+-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+This is a clearsigned message!
+- - dash line
+-----BEGIN PGP SIGNATURE-----
+
+wsBzBAEBCAAnBQJeTcwACRAwchXBPfepZBYhBLGoZpNUFTt5nyIXvzByFcE996lk
+AAAzwQf+Igbn1GOkotIyJCw1m/ixJuoqlGIA1iHwqM1Qk6s0v42eLw6ycWY3inPc
+f0xgB7Kz6aPf5/nPNP2LflKNYyDAw3cAkBsWvZrr1qHyyEBpqDnaqXWd2ygfT5/6
+YQvvtS5UxidrJj0baO0qB/BmDAcDF4CqfbQIroqSGrRNpIxb/LhN8peF0RcY80Y/
+bArv/jnYahLS32hKbjNIwNFK1PP4tHbkQdMGDDEKYA/MtWsrULA68h0ms0xQ5WEb
+C3zh8UAYydR0U+u2tAk7jNuSg8jFuHOPVNPDUYAdDIz00becy4w1bv59ZAC1BIWz
+iwffr3KWYlRdfgJYz21ccl6Gslje/A==
+=8tqr
+-----END PGP SIGNATURE-----
+`)
+
+var testInlineSignedQuotedPrintable = toCRLF(`From: John Doe <john.doe@example.org>
+To: John Doe <john.doe@example.org>
+Mime-Version: 1.0
+Content-Type: text/plain
+Content-Transfer-Encoding: quoted-printable
+
+-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+This is a clearsigned message!
+- - dash line
+-----BEGIN PGP SIGNATURE-----
+
+wsBzBAEBCAAnBQJeTcwACRAwchXBPfepZBYhBLGoZpNUFTt5nyIXvzByFcE996lk
+AAAzwQf+Igbn1GOkotIyJCw1m/ixJuoqlGIA1iHwqM1Qk6s0v42eLw6ycWY3inPc
+f0xgB7Kz6aPf5/nPNP2LflKNYyDAw3cAkBsWvZrr1qHyyEBpqDnaqXWd2ygfT5/6
+YQvvtS5UxidrJj0baO0qB/BmDAcDF4CqfbQIroqSGrRNpIxb/LhN8peF0RcY80Y/
+bArv/jnYahLS32hKbjNIwNFK1PP4tHbkQdMGDDEKYA/MtWsrULA68h0ms0xQ5WEb
+C3zh8UAYydR0U+u2tAk7jNuSg8jFuHOPVNPDUYAdDIz00becy4w1bv59ZAC1BIWz
+iwffr3KWYlRdfgJYz21ccl6Gslje/A=3D=3D
+=3D8tqr
+-----END PGP SIGNATURE-----
+`)
+
+var testInlineEncryptedBody = toCRLF(`Content-Type: text/plain
+
+Hello!
+This is an inline encrypted message!
+-- 
+Footer
+`)
+
+var testInlineEncrypted = toCRLF(`From: John Doe <john.doe@example.org>
+To: John Doe <john.doe@example.org>
+Mime-Version: 1.0
+Content-Type: text/plain
+
+Hello!
+-----BEGIN PGP MESSAGE-----
+
+wcBMAxF0jxulHQ8+AQf+K7wor7z3ZiDId2QSmqBzUnXJGCok4+cBsktDvHW/L3J4
+Bn2sHrjeNfCiW2i1ywymzUXE7tPmMFkh+7tj1CnX6HVzr7WE017ruixitcEAorxx
+Y4J4+A46Zea2qwtl3jpqPtHQiAyaTNno+tutTa/jrs0YEMGh5hgYOmZ1mS1kUnEe
+p+4Tm0OQ5AwKQO1M8v2BTPMnyGW/FbGEb6Z678MYbYTvK/hLPGRyrpAm8kKjUMMP
+UAC8gYv1Rx/RnHpJdT0ap+BnWaHRt5Y8zlCn/7Q0WorqgjBK1783VGWn3kXohIdL
+yZ5RA34Ek471IKSmfI4DVBEGZLqEqBGvT1fhrRjhw9LA3AHRCm8ZxoGxDS4dakyu
+YaH2/4XGX1DRveaql1XK44Jyn97nAbBlzq02EqDSCnee9RiT8t9Ou5WSEN06BtMW
+SbTcCAwSy2J0jJ23fKp6UDsRx81JoeASL3XNBDNRfwugC1BRzrw9Hdm/zsh3EDoO
+TIwGybYL29BAahhxJVs0ZQ5fox0qUW2OSdfDyKSEObejm1LOSrvOZpSnRuk4yXB4
++mmHGMaAuVK2ySKyDMjn6jk6e2lA9lkiaXITeLIxw7O65/lpj2QBL8y9cWWJ/Y1t
+CxmQ6CWuCd7s6HT02HO7che5x0bGLRXNJWkyQY7TtnO1Z6uROpPi9D//kXPpgZJ1
+XC0Lkz5ip5jwvr24mV9+Two0oxEUayufJitLmllfIdkUosOLkZpB2SigTZAr+n8Y
+AEGm7oNnZ4JGm/fUTDuV1ENxMuFnUp9BgYDyQR6emj7yotENdQcSrPSUvBnzjngf
+B1dqImYy7mn77n/laLENPZ6u9624V7cDKS/oVAJxqFaAUqJ9/RpRiC6rrcFPiFda
+6ZkR1087Y58xbbD0cDs=
+=82v0
+-----END PGP MESSAGE-----
+-- 
+Footer
+`)
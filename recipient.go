@@ -0,0 +1,96 @@
+package pgpmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// Recipient is a recipient of an encrypted message, as listed in a public-key
+// encrypted session key packet.
+type Recipient struct {
+	KeyId      uint64
+	PubKeyAlgo packet.PublicKeyAlgorithm
+	// Fingerprint is the fingerprint of the recipient key. Session key
+	// packets only contain a key ID, so it is only set if the public key is
+	// in the keyring.
+	Fingerprint []byte
+	// Hidden is true if the key ID is a wildcard: the recipient is hidden.
+	// All decryption keys of the keyring are tried for such recipients.
+	Hidden bool
+}
+
+// recordingReader records the data read from an io.Reader, until stop is
+// called.
+type recordingReader struct {
+	r   io.Reader
+	buf *bytes.Buffer
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.buf != nil {
+		r.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+func (r *recordingReader) stop() []byte {
+	b := r.buf.Bytes()
+	r.buf = nil
+	return b
+}
+
+// readRecipients parses the public-key encrypted session key packets at the
+// start of a message.
+func readRecipients(b []byte, keyring openpgp.KeyRing) []Recipient {
+	var recipients []Recipient
+	pr := packet.NewReader(bytes.NewReader(b))
+	for {
+		p, err := pr.Next()
+		if err != nil {
+			return recipients
+		}
+		switch p := p.(type) {
+		case *packet.EncryptedKey:
+			rcpt := Recipient{
+				KeyId:      p.KeyId,
+				PubKeyAlgo: p.Algo,
+				Hidden:     p.KeyId == 0,
+			}
+			if keyring != nil && !rcpt.Hidden {
+				if keys := keyring.KeysById(p.KeyId); len(keys) > 0 {
+					rcpt.Fingerprint = keys[0].PublicKey.Fingerprint
+				}
+			}
+			recipients = append(recipients, rcpt)
+		case *packet.SymmetricKeyEncrypted:
+			// Continue
+		default:
+			return recipients
+		}
+	}
+}
+
+// readMessage is a wrapper for openpgp.ReadMessage. It also returns the
+// recipients of the message. The signature error is ErrNotVerified until the
+// body has been read through a signatureCheckReader.
+func readMessage(r io.Reader, options *ReadOptions) (*openpgp.MessageDetails, []Recipient, error) {
+	// The session key packets are recorded to report the recipients
+	rr := &recordingReader{r: r, buf: new(bytes.Buffer)}
+	md, err := openpgp.ReadMessage(rr, options.KeyRing, options.Prompt, options.Config)
+	recipients := readRecipients(rr.stop(), options.KeyRing)
+	if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+		return nil, nil, &MissingKeyError{Recipients: recipients, Err: err}
+	} else if err != nil {
+		return nil, nil, errorf(pgpErrorKind(err), "pgpmail: failed to read PGP message: %w", err)
+	}
+	if md.IsSigned && md.SignatureError == nil {
+		md.SignatureError = ErrNotVerified
+	}
+	return md, recipients, nil
+}
@@ -0,0 +1,72 @@
+package pgpmail
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ReplayCache records the signatures which have been seen, to detect signed
+// messages sent again later, possibly to a different recipient.
+//
+// A server receiving a message for several recipients should use a separate
+// ReplayCache for each recipient.
+type ReplayCache interface {
+	// Seen records a signature, identified by its hash. It returns true if
+	// the signature was already recorded.
+	Seen(hash []byte) (bool, error)
+}
+
+// MemoryReplayCache is a ReplayCache keeping signatures in memory.
+type MemoryReplayCache struct {
+	mutex  sync.Mutex
+	hashes map[string]struct{}
+}
+
+var _ ReplayCache = (*MemoryReplayCache)(nil)
+
+// NewMemoryReplayCache creates a new empty in-memory cache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{hashes: make(map[string]struct{})}
+}
+
+func (c *MemoryReplayCache) Seen(hash []byte) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	k := string(hash)
+	_, ok := c.hashes[k]
+	c.hashes[k] = struct{}{}
+	return ok, nil
+}
+
+// signatureHash returns the SHA-256 hash of a serialized signature packet.
+func signatureHash(sig *packet.Signature) ([]byte, error) {
+	h := sha256.New()
+	if err := sig.Serialize(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// checkReplay records sig in cache. If cache is nil, no check is performed.
+func checkReplay(cache ReplayCache, sig *packet.Signature) error {
+	if cache == nil {
+		return nil
+	}
+
+	hash, err := signatureHash(sig)
+	if err != nil {
+		return fmt.Errorf("pgpmail: failed to hash signature: %w", err)
+	}
+	seen, err := cache.Seen(hash)
+	if err != nil {
+		return fmt.Errorf("pgpmail: failed to check replay cache: %w", err)
+	}
+	if seen {
+		return ErrReplay
+	}
+	return nil
+}
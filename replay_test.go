@@ -0,0 +1,44 @@
+package pgpmail
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestReader_replay(t *testing.T) {
+	for name, msg := range map[string]string{
+		"signed":           testPGPMIMESigned,
+		"encrypted+signed": testPGPMIMEEncryptedSigned,
+	} {
+		cache := NewMemoryReplayCache()
+		policyCalls := 0
+
+		for i, want := range []error{nil, ErrReplay} {
+			r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+				KeyRing:     openpgp.EntityList{testPrivateKey},
+				ReplayCache: cache,
+				SignaturePolicy: func(res *SignatureResult) error {
+					policyCalls++
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("%v: pgpmail.ReadWithOptions() = %v", name, err)
+			}
+			if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+				t.Fatalf("%v: io.Copy() = %v", name, err)
+			}
+			if err := r.MessageDetails.SignatureError; err != want {
+				t.Errorf("%v: read #%v: MessageDetails.SignatureError = %v, want %v", name, i, err, want)
+			}
+		}
+
+		if policyCalls != 1 {
+			t.Errorf("%v: SignaturePolicy called %v times, want 1", name, policyCalls)
+		}
+	}
+}
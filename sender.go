@@ -0,0 +1,128 @@
+package pgpmail
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// ErrSenderMismatch is returned by Reader.CheckSender if the message has
+	// a valid signature, but the signing key doesn't belong to the sender.
+	ErrSenderMismatch error = validityError("message is signed by a key for a different address")
+	// ErrSenderOnly is returned by Reader.CheckSender if the signing key
+	// belongs to the Sender address, but not to the From address: the
+	// message claims to be written by someone else than the signer.
+	ErrSenderOnly error = validityError("message is signed by the Sender address, not by the From address")
+)
+
+// CheckSender checks that the key which signed the message has a user ID
+// matching the From address of the message. The From header fields of both
+// the outer header and the protected header are checked. If the signing key
+// only matches the Sender address, ErrSenderOnly is returned.
+//
+// CheckSender must be called after MessageDetails.UnverifiedBody has been
+// read. If the signature isn't valid, its error is returned.
+func (r *Reader) CheckSender() error {
+	md := r.MessageDetails
+	if !md.IsSigned {
+		return ErrNotSigned
+	}
+	if md.SignatureError != nil {
+		return md.SignatureError
+	}
+	if md.SignedBy == nil || md.SignedBy.Entity == nil {
+		return ErrNotVerified
+	}
+
+	headers := []textproto.Header{r.Header}
+	if r.ProtectedHeader != nil {
+		headers = append(headers, *r.ProtectedHeader)
+	}
+
+	uids := entityAddresses(md.SignedBy.Entity, r.config.Now())
+	checked := false
+	for _, h := range headers {
+		from := headerAddresses(h, "From")
+		if len(from) == 0 {
+			continue
+		}
+		checked = true
+
+		if matchAddresses(uids, from) {
+			continue
+		}
+		if matchAddresses(uids, headerAddresses(h, "Sender")) {
+			return ErrSenderOnly
+		}
+		return ErrSenderMismatch
+	}
+	if !checked {
+		return errorf(ErrMalformed, "pgpmail: message doesn't have a From address")
+	}
+	return nil
+}
+
+// headerAddresses returns the addresses of the header field k.
+func headerAddresses(h textproto.Header, k string) []string {
+	mh := mail.Header{Header: message.Header{Header: h}}
+	l, err := mh.AddressList(k)
+	if err != nil {
+		return nil
+	}
+
+	addrs := make([]string, len(l))
+	for i, addr := range l {
+		addrs[i] = addr.Address
+	}
+	return addrs
+}
+
+// matchAddresses returns true if one of addrs is in uids.
+func matchAddresses(uids map[string]bool, addrs []string) bool {
+	for _, addr := range addrs {
+		if uids[normalizeAddress(addr)] {
+			return true
+		}
+	}
+	return false
+}
+
+// entityAddresses returns the normalized email addresses of the user IDs of
+// e which aren't revoked.
+func entityAddresses(e *openpgp.Entity, now time.Time) map[string]bool {
+	addrs := make(map[string]bool)
+	for _, ident := range e.Identities {
+		if ident.UserId == nil || ident.UserId.Email == "" || ident.Revoked(now) {
+			continue
+		}
+		addrs[normalizeAddress(ident.UserId.Email)] = true
+	}
+	return addrs
+}
+
+// normalizeAddress converts an email address to a form suitable for
+// comparison: it is converted to lower case and NFC, and internationalized
+// domain names are converted to Unicode.
+func normalizeAddress(addr string) string {
+	addr = norm.NFC.String(strings.TrimSpace(addr))
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return strings.ToLower(addr)
+	}
+	local, domain := strings.ToLower(addr[:i]), strings.TrimSuffix(addr[i+1:], ".")
+
+	// The lookup profile maps the domain to lower case and NFC
+	if s, err := idna.Lookup.ToUnicode(domain); err == nil {
+		domain = s
+	} else {
+		domain = strings.ToLower(domain)
+	}
+	return local + "@" + domain
+}
@@ -0,0 +1,104 @@
+package pgpmail
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/emersion/go-message/textproto"
+)
+
+func readSigned(t *testing.T, msg string) *Reader {
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	return r
+}
+
+func TestReader_CheckSender(t *testing.T) {
+	r := readSigned(t, testPGPMIMESigned)
+	if err := r.CheckSender(); err != nil {
+		t.Errorf("Reader.CheckSender() = %v", err)
+	}
+
+	msg := strings.Replace(testPGPMIMESigned, "From: John Doe <john.doe@example.org>", "From: Jane <jane@example.org>", 1)
+	r = readSigned(t, msg)
+	if err := r.CheckSender(); err != ErrSenderMismatch {
+		t.Errorf("Reader.CheckSender() = %v, want ErrSenderMismatch", err)
+	}
+
+	msg = strings.Replace(testPGPMIMESigned, "From: John Doe <john.doe@example.org>", "From: John Doe <John.Doe@EXAMPLE.org>", 1)
+	r = readSigned(t, msg)
+	if err := r.CheckSender(); err != nil {
+		t.Errorf("Reader.CheckSender() with different case = %v", err)
+	}
+}
+
+func TestReader_CheckSender_sender(t *testing.T) {
+	msg := strings.Replace(testPGPMIMESigned, "From: John Doe <john.doe@example.org>", "From: CEO <ceo@bank.example>\r\nSender: John Doe <john.doe@example.org>", 1)
+	r := readSigned(t, msg)
+	if err := r.CheckSender(); err != ErrSenderOnly {
+		t.Errorf("Reader.CheckSender() = %v, want ErrSenderOnly", err)
+	}
+
+	msg = strings.Replace(testPGPMIMESigned, "From: John Doe <john.doe@example.org>", "From: John Doe <john.doe@example.org>\r\nSender: Jane <jane@example.org>", 1)
+	r = readSigned(t, msg)
+	if err := r.CheckSender(); err != nil {
+		t.Errorf("Reader.CheckSender() with a different Sender = %v", err)
+	}
+
+	msg = strings.Replace(testPGPMIMESigned, "From: John Doe <john.doe@example.org>", "Sender: John Doe <john.doe@example.org>", 1)
+	r = readSigned(t, msg)
+	if err := r.CheckSender(); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Reader.CheckSender() without From = %v, want ErrMalformed", err)
+	}
+}
+
+func TestReader_CheckSender_encapsulated(t *testing.T) {
+	r := readSigned(t, testPGPMIMEEncryptedSignedEncapsulated)
+	if err := r.CheckSender(); err != nil {
+		t.Errorf("Reader.CheckSender() = %v", err)
+	}
+
+	msg := strings.Replace(testPGPMIMEEncryptedSignedEncapsulated, "From: John Doe <john.doe@example.org>", "From: Jane <jane@example.org>", 1)
+	r = readSigned(t, msg)
+	if err := r.CheckSender(); err != ErrSenderMismatch {
+		t.Errorf("Reader.CheckSender() = %v, want ErrSenderMismatch", err)
+	}
+}
+
+func TestReader_CheckSender_protected(t *testing.T) {
+	r := readSigned(t, testPGPMIMESigned)
+
+	var protected textproto.Header
+	protected.Set("From", "Jane <jane@example.org>")
+	r.ProtectedHeader = &protected
+	if err := r.CheckSender(); err != ErrSenderMismatch {
+		t.Errorf("Reader.CheckSender() = %v, want ErrSenderMismatch", err)
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"John.Doe@Example.org", "john.doe@example.org"},
+		{"jane@xn--bcher-kva.example", "jane@bücher.example"},
+		{"jane@BÜCHER.example.", "jane@bücher.example"},
+		{"jane@bu\u0308cher.example", "jane@bücher.example"},
+		{"Jose\u0301@example.org", "josé@example.org"},
+		{"jane@xn--ihqwcrb4cv8a8dqg056pqjye.example", "jane@他们为什么不说中文.example"},
+	}
+	for _, tc := range tests {
+		if got := normalizeAddress(tc.addr); got != tc.want {
+			t.Errorf("normalizeAddress(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
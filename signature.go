@@ -0,0 +1,459 @@
+package pgpmail
+
+import (
+	"bytes"
+	"crypto"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// SignatureResult is the result of the verification of a single signature.
+type SignatureResult struct {
+	IssuerKeyId       uint64
+	IssuerFingerprint []byte
+	Hash              crypto.Hash
+	CreationTime      time.Time
+	// SignedBy is the key which issued the signature, or nil if the signature
+	// couldn't be verified. It is also set if the signature is
+	// cryptographically valid but Err is a validity error, e.g.
+	// ErrKeyRevoked.
+	SignedBy *openpgp.Key
+	// Err is nil if the signature is valid.
+	Err error
+}
+
+var (
+	// ErrNotVerified is the signature error of a signed message whose body
+	// hasn't been read yet. See Reader.Verify.
+	ErrNotVerified = errors.New("pgpmail: signature hasn't been verified yet")
+	// ErrNotSigned is returned by Reader.Verify if the message isn't signed.
+	ErrNotSigned = errors.New("pgpmail: message isn't signed")
+)
+
+type validityError string
+
+func (err validityError) Error() string {
+	return "pgpmail: " + string(err)
+}
+
+// Errors returned for signatures which are cryptographically valid, but which
+// were made with a key which wasn't valid, or which aren't valid anymore.
+var (
+	ErrKeyRevoked           error = validityError("signing key is revoked")
+	ErrKeyExpired           error = validityError("signing key was expired at signature creation time")
+	ErrKeyNotYetValid       error = validityError("signing key was created after the signature")
+	ErrSignatureExpired     error = validityError("signature is expired")
+	ErrSignatureInTheFuture error = validityError("signature is created in the future")
+	ErrDateSkew             error = validityError("signature creation time doesn't match the Date header field")
+	ErrReplay               error = validityError("signature has already been seen")
+)
+
+// pgpValidityErrors maps the validity errors returned by go-crypto for
+// one-pass signatures to the ones returned by this package.
+var pgpValidityErrors = map[error]error{
+	pgperrors.ErrKeyRevoked:       ErrKeyRevoked,
+	pgperrors.ErrKeyExpired:       ErrKeyExpired,
+	pgperrors.ErrSignatureExpired: ErrSignatureExpired,
+}
+
+// signatureCheckReader reads the body of a message read by readMessage, and
+// annotates read errors. If the message is signed, it completes the
+// verification of the signature once the body has been read. dates contains
+// the dates claimed by the message header fields. The results are stored in
+// signatures.
+type signatureCheckReader struct {
+	io.Reader
+	md         *openpgp.MessageDetails
+	options    *ReadOptions
+	dates      []time.Time
+	signatures *[]*SignatureResult
+	done       bool
+}
+
+func (r *signatureCheckReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		err = errorf(pgpErrorKind(err), "pgpmail: failed to read PGP message: %w", err)
+	}
+	if err != io.EOF || r.done || !r.md.IsSigned {
+		return n, err
+	}
+	r.done = true
+
+	md := r.md
+	var results []*SignatureResult
+	switch sigErr := md.SignatureError; {
+	case sigErr == ErrNotVerified:
+		// openpgp only checks signatures made by a key of the keyring
+		md.SignatureError = ErrUnknownIssuer
+		for _, sig := range md.UnverifiedSignatures {
+			res := newSignatureResult(sig)
+			res.Err = ErrUnknownIssuer
+			results = append(results, res)
+		}
+	case sigErr == nil:
+		res := newSignatureResult(md.Signature)
+		res.SignedBy = md.SignedBy
+		res.Err = checkVerifiedSignature(res, r.options, r.dates, md.Signature)
+		md.SignatureError = res.Err
+		results = append(results, res)
+	default:
+		kind := pgpErrorKind(sigErr)
+		if err, ok := pgpValidityErrors[sigErr]; ok {
+			md.SignatureError = err
+		} else if kind != nil {
+			md.SignatureError = errorf(kind, "pgpmail: %w", sigErr)
+		}
+		if md.Signature != nil {
+			res := newSignatureResult(md.Signature)
+			res.Err = md.SignatureError
+			if kind == nil {
+				// The signature is valid, but the key isn't
+				res.SignedBy = md.SignedBy
+			}
+			results = append(results, res)
+		}
+	}
+	if r.signatures != nil {
+		*r.signatures = results
+	}
+	return n, err
+}
+
+// Verify reads the rest of the message body, and returns the result of the
+// signature verification. If the message has nested layers, all of their
+// signatures must be valid. ErrNotSigned is returned if no layer is signed.
+func (r *Reader) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		return errorf(pgpErrorKind(err), "pgpmail: failed to read message body: %w", err)
+	}
+
+	layers := r.Layers
+	if len(layers) == 0 {
+		layers = []*Reader{r}
+	}
+
+	signed := false
+	for _, layer := range layers {
+		md := layer.MessageDetails
+		if !md.IsSigned {
+			continue
+		}
+		signed = true
+		if md.SignatureError != nil {
+			return md.SignatureError
+		}
+	}
+	if !signed {
+		return ErrNotSigned
+	}
+	return nil
+}
+
+// newSignatureResult returns a SignatureResult describing sig, before it is
+// verified.
+func newSignatureResult(sig *packet.Signature) *SignatureResult {
+	res := &SignatureResult{
+		IssuerFingerprint: sig.IssuerFingerprint,
+		Hash:              sig.Hash,
+		CreationTime:      sig.CreationTime,
+	}
+	if sig.IssuerKeyId != nil {
+		res.IssuerKeyId = *sig.IssuerKeyId
+	}
+	return res
+}
+
+// cloneHash returns a copy of h, which must have been created by hashFunc.
+func cloneHash(hashFunc crypto.Hash, h hash.Hash) (hash.Hash, error) {
+	marshaler, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errorf(ErrUnsupported, "pgpmail: hash %v can't be copied", hashFunc)
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	clone := hashFunc.New()
+	if err := clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// verifySignatures reads signature packets from sigs and verifies them against
+// the signed data. hashSigned is called with the hash function of a signature
+// packet and returns a new hash of the signed data. dates contains the dates
+// claimed by the message header fields.
+//
+// The first valid signature is stored in md. The returned error is nil if at
+// least one signature is valid.
+func verifySignatures(md *openpgp.MessageDetails, options *ReadOptions, dates []time.Time, sigs io.Reader, hashSigned func(crypto.Hash) (hash.Hash, error)) ([]*SignatureResult, error) {
+	var results []*SignatureResult
+	pr := packet.NewReader(sigs)
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			kind := pgpErrorKind(err)
+			if kind == nil {
+				kind = ErrMalformed
+			}
+			return results, errorf(kind, "pgpmail: failed to read signature: %w", err)
+		}
+
+		sig, ok := p.(*packet.Signature)
+		if !ok {
+			return results, errorf(ErrMalformed, "pgpmail: non signature packet found")
+		}
+
+		res := newSignatureResult(sig)
+		res.Err = verifySignature(res, options, dates, sig, hashSigned)
+		results = append(results, res)
+	}
+
+	if len(results) == 0 {
+		return nil, errorf(ErrMalformed, "pgpmail: no signature found")
+	}
+
+	for _, res := range results {
+		if res.Err == nil {
+			md.SignedByKeyId = res.IssuerKeyId
+			md.SignedBy = res.SignedBy
+			return results, nil
+		}
+	}
+
+	// Report the most relevant error: an unknown issuer is only reported if
+	// no signature could be checked
+	md.SignedByKeyId = results[0].IssuerKeyId
+	for _, res := range results {
+		if !errors.Is(res.Err, ErrUnknownIssuer) {
+			return results, res.Err
+		}
+	}
+	return results, pgperrors.ErrUnknownIssuer
+}
+
+// issuerKeys returns the signing keys which may have issued sig.
+func issuerKeys(options *ReadOptions, sig *packet.Signature) ([]openpgp.Key, error) {
+	keyring := options.KeyRing
+	if keyring == nil {
+		keyring = openpgp.EntityList(nil)
+	}
+
+	// Key IDs may collide, prefer the fingerprint
+	if fpr := sig.IssuerFingerprint; len(fpr) > 0 {
+		var id uint64
+		switch len(fpr) {
+		case 20:
+			id = binary.BigEndian.Uint64(fpr[12:20])
+		case 32:
+			id = binary.BigEndian.Uint64(fpr[:8])
+		default:
+			return nil, errorf(ErrMalformed, "pgpmail: invalid issuer fingerprint length %v", len(fpr))
+		}
+
+		var keys []openpgp.Key
+		for _, key := range keyring.KeysByIdUsage(id, packet.KeyFlagSign) {
+			if bytes.Equal(key.PublicKey.Fingerprint, fpr) {
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	if sig.IssuerKeyId != nil {
+		return keyring.KeysByIdUsage(*sig.IssuerKeyId, packet.KeyFlagSign), nil
+	}
+
+	if !options.TryAllSigningKeys {
+		return nil, errorf(ErrUnknownIssuer, "pgpmail: signature doesn't have an issuer")
+	}
+
+	el, ok := keyring.(openpgp.EntityList)
+	if !ok {
+		return nil, errorf(ErrUnknownIssuer, "pgpmail: signature doesn't have an issuer and keyring can't be enumerated")
+	}
+	var keys []openpgp.Key
+	for _, e := range el {
+		ids := []uint64{e.PrimaryKey.KeyId}
+		for _, subkey := range e.Subkeys {
+			ids = append(ids, subkey.PublicKey.KeyId)
+		}
+		for _, id := range ids {
+			keys = append(keys, openpgp.EntityList{e}.KeysByIdUsage(id, packet.KeyFlagSign)...)
+		}
+	}
+	return keys, nil
+}
+
+func verifySignature(res *SignatureResult, options *ReadOptions, dates []time.Time, sig *packet.Signature, hashSigned func(crypto.Hash) (hash.Hash, error)) error {
+	// The hash algorithm is checked first, so that a mismatch isn't hidden
+	// by an unknown issuer
+	h, err := hashSigned(sig.Hash)
+	if err != nil {
+		return err
+	}
+
+	keys, err := issuerKeys(options, sig)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return pgperrors.ErrUnknownIssuer
+	}
+
+	for i, key := range keys {
+		// VerifySignature consumes the hash
+		if i > 0 {
+			h, err = hashSigned(sig.Hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = key.PublicKey.VerifySignature(h, sig)
+		if err == nil {
+			res.SignedBy = &keys[i]
+			if res.IssuerKeyId == 0 {
+				res.IssuerKeyId = key.PublicKey.KeyId
+			}
+			return checkVerifiedSignature(res, options, dates, sig)
+		}
+	}
+	return errorf(ErrBadSignature, "pgpmail: bad signature: %w", err)
+}
+
+// checkVerifiedSignature performs the checks enabled by options on a signature which
+// is cryptographically valid. res.SignedBy must be set.
+func checkVerifiedSignature(res *SignatureResult, options *ReadOptions, dates []time.Time, sig *packet.Signature) error {
+	if err := checkValidity(res.SignedBy, sig, options.Config.Now()); err != nil {
+		return err
+	}
+	if err := checkDates(res.SignedBy, sig, options.MaxDateSkew, dates); err != nil {
+		return err
+	}
+	if err := checkReplay(options.ReplayCache, sig); err != nil {
+		return err
+	}
+	if options.SignaturePolicy != nil {
+		return options.SignaturePolicy(res)
+	}
+	return nil
+}
+
+// isRevoked returns true if one of the revocations applies to a signature
+// created at t. Revocations for a compromised key, or without a reason, apply
+// to all signatures. Other revocations only apply to signatures created
+// afterwards.
+func isRevoked(revocations []*packet.Signature, t time.Time) bool {
+	for _, rev := range revocations {
+		if rev.RevocationReason == nil || *rev.RevocationReason == packet.NoReason || *rev.RevocationReason == packet.KeyCompromised {
+			return true
+		}
+		if !rev.CreationTime.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyExpired checks whether pk was valid at t, according to its self-signature.
+func keyExpired(pk *packet.PublicKey, selfSig *packet.Signature, t time.Time) error {
+	if pk.CreationTime.After(t) {
+		return ErrKeyNotYetValid
+	}
+	if selfSig != nil && pk.KeyExpired(selfSig, t) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// checkKeyValidity checks that key was valid at t.
+func checkKeyValidity(key *openpgp.Key, t time.Time) error {
+	e := key.Entity
+
+	if isRevoked(e.Revocations, t) || isRevoked(key.Revocations, t) {
+		return ErrKeyRevoked
+	}
+
+	var primarySelfSig *packet.Signature
+	if ident := e.PrimaryIdentity(); ident != nil {
+		primarySelfSig = ident.SelfSignature
+	}
+	if err := keyExpired(e.PrimaryKey, primarySelfSig, t); err != nil {
+		return err
+	}
+	if key.PublicKey != e.PrimaryKey {
+		if err := keyExpired(key.PublicKey, key.SelfSignature, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkValidity checks that the key which issued sig was valid at the
+// signature creation time, and that sig is valid at now.
+func checkValidity(key *openpgp.Key, sig *packet.Signature, now time.Time) error {
+	t := sig.CreationTime
+	if err := checkKeyValidity(key, t); err != nil {
+		return err
+	}
+
+	if t.After(now) {
+		return ErrSignatureInTheFuture
+	}
+	if sig.SigExpired(now) {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// messageDates returns the dates of the Date header fields of hs.
+func messageDates(hs ...textproto.Header) []time.Time {
+	var dates []time.Time
+	for _, h := range hs {
+		mh := mail.Header{Header: message.Header{Header: h}}
+		if date, err := mh.Date(); err == nil && !date.IsZero() {
+			dates = append(dates, date)
+		}
+	}
+	return dates
+}
+
+// checkDates checks that sig was created at most maxSkew away from the dates
+// claimed by the message, and that key was valid at these dates. If maxSkew
+// is zero, no check is performed.
+func checkDates(key *openpgp.Key, sig *packet.Signature, maxSkew time.Duration, dates []time.Time) error {
+	if maxSkew == 0 {
+		return nil
+	}
+	for _, date := range dates {
+		skew := sig.CreationTime.Sub(date)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > maxSkew {
+			return ErrDateSkew
+		}
+		if err := checkKeyValidity(key, date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,556 @@
+package pgpmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message/textproto"
+)
+
+var testSignedMultiBody = toCRLF(`Content-Type: text/plain
+
+This message has several signatures.
+`)
+
+// formatMultiSigned formats a multipart/signed message with one signature
+// per signer.
+func formatMultiSigned(t *testing.T, body string, signers []*openpgp.Entity, config *packet.Config) string {
+	var sigs bytes.Buffer
+	for _, signer := range signers {
+		if err := openpgp.DetachSignText(&sigs, signer, strings.NewReader(body), config); err != nil {
+			t.Fatalf("openpgp.DetachSignText() = %v", err)
+		}
+	}
+
+	return formatSignedPackets(t, body, sigs.Bytes())
+}
+
+// formatSignedPackets formats a multipart/signed message with the provided
+// signature packets.
+func formatSignedPackets(t *testing.T, body string, sigs []byte) string {
+	var armored bytes.Buffer
+	armorWriter, err := armor.Encode(&armored, "PGP SIGNATURE", nil)
+	if err != nil {
+		t.Fatalf("armor.Encode() = %v", err)
+	}
+	armorWriter.Write(sigs)
+	armorWriter.Close()
+
+	return toCRLF(`From: John Doe <john.doe@example.org>
+To: John Doe <john.doe@example.org>
+Mime-Version: 1.0
+Content-Type: multipart/signed; boundary=bar; micalg=pgp-sha256;
+   protocol="application/pgp-signature"
+
+--bar
+`) + body + toCRLF(`
+--bar
+Content-Type: application/pgp-signature
+
+`) + toCRLF(armored.String()) + toCRLF(`
+--bar--
+`)
+}
+
+// formatEncryptedSigned formats a message encrypted to testPublicKey and
+// signed by signer.
+func formatEncryptedSigned(t *testing.T, signer *openpgp.Entity, config *packet.Config) string {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	cleartext, err := Encrypt(&buf, h, []*openpgp.Entity{testPublicKey}, signer, config)
+	if err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, testSignedMultiBody); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+	return buf.String()
+}
+
+func newTestEntity(t *testing.T, name, email string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", email, &packet.Config{
+		Algorithm: packet.PubKeyAlgoEdDSA,
+		Time:      testConfig.Time,
+	})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+	return e
+}
+
+func TestReader_signatures(t *testing.T) {
+	other := newTestEntity(t, "Jane", "jane@example.org")
+	config := &packet.Config{DefaultHash: crypto.SHA256, Time: testConfig.Time}
+	msg := formatMultiSigned(t, testSignedMultiBody, []*openpgp.Entity{other, testPrivateKey}, config)
+
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if s := string(b); s != testSignedMultiBody {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, testSignedMultiBody)
+	}
+
+	checkSignature(t, r.MessageDetails)
+
+	if len(r.Signatures) != 2 {
+		t.Fatalf("len(Reader.Signatures) = %v, want 2", len(r.Signatures))
+	}
+
+	unknown := r.Signatures[0]
+	if unknown.IssuerKeyId != other.PrimaryKey.KeyId {
+		t.Errorf("Signatures[0].IssuerKeyId = %X, want %X", unknown.IssuerKeyId, other.PrimaryKey.KeyId)
+	}
+	if unknown.Err != pgperrors.ErrUnknownIssuer {
+		t.Errorf("Signatures[0].Err = %v, want ErrUnknownIssuer", unknown.Err)
+	}
+	if unknown.SignedBy != nil {
+		t.Errorf("Signatures[0].SignedBy = %v, want nil", unknown.SignedBy)
+	}
+
+	valid := r.Signatures[1]
+	if valid.Err != nil {
+		t.Errorf("Signatures[1].Err = %v", valid.Err)
+	}
+	if valid.IssuerKeyId != testPublicKey.PrimaryKey.KeyId {
+		t.Errorf("Signatures[1].IssuerKeyId = %X, want %X", valid.IssuerKeyId, testPublicKey.PrimaryKey.KeyId)
+	}
+	if valid.SignedBy == nil || valid.SignedBy.PublicKey.KeyId != testPublicKey.PrimaryKey.KeyId {
+		t.Errorf("Signatures[1].SignedBy doesn't match test key")
+	}
+	if valid.Hash != crypto.SHA256 {
+		t.Errorf("Signatures[1].Hash = %v, want %v", valid.Hash, crypto.SHA256)
+	}
+	if !valid.CreationTime.Equal(testConfig.Now()) {
+		t.Errorf("Signatures[1].CreationTime = %v, want %v", valid.CreationTime, testConfig.Now())
+	}
+}
+
+func TestReader_signaturesEncrypted(t *testing.T) {
+	other := newTestEntity(t, "Jane", "jane@example.org")
+
+	tests := []struct {
+		name   string
+		signer *openpgp.Entity
+		want   error
+	}{
+		{"valid", testPrivateKey, nil},
+		{"unknown issuer", other, ErrUnknownIssuer},
+	}
+	for _, tc := range tests {
+		msg := formatEncryptedSigned(t, tc.signer, testConfig)
+
+		r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPrivateKey}, nil, nil)
+		if err != nil {
+			t.Fatalf("%v: pgpmail.Read() = %v", tc.name, err)
+		}
+		if err := r.Verify(); err != tc.want {
+			t.Errorf("%v: Reader.Verify() = %v, want %v", tc.name, err, tc.want)
+		}
+
+		if len(r.Signatures) != 1 {
+			t.Fatalf("%v: len(Reader.Signatures) = %v, want 1", tc.name, len(r.Signatures))
+		}
+		res := r.Signatures[0]
+		if res.Err != tc.want {
+			t.Errorf("%v: Signatures[0].Err = %v, want %v", tc.name, res.Err, tc.want)
+		}
+		if res.IssuerKeyId != tc.signer.PrimaryKey.KeyId {
+			t.Errorf("%v: Signatures[0].IssuerKeyId = %X, want %X", tc.name, res.IssuerKeyId, tc.signer.PrimaryKey.KeyId)
+		}
+		if (res.SignedBy != nil) != (tc.want == nil) {
+			t.Errorf("%v: Signatures[0].SignedBy = %v", tc.name, res.SignedBy)
+		}
+		if !res.CreationTime.Equal(testConfig.Now()) {
+			t.Errorf("%v: Signatures[0].CreationTime = %v, want %v", tc.name, res.CreationTime, testConfig.Now())
+		}
+	}
+}
+
+func TestReader_signaturesAllValid(t *testing.T) {
+	other := newTestEntity(t, "Jane", "jane@example.org")
+	config := &packet.Config{DefaultHash: crypto.SHA256, Time: testConfig.Time}
+	msg := formatMultiSigned(t, testSignedMultiBody, []*openpgp.Entity{testPrivateKey, other}, config)
+
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPublicKey, other}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+
+	checkSignature(t, r.MessageDetails)
+	if len(r.Signatures) != 2 {
+		t.Fatalf("len(Reader.Signatures) = %v, want 2", len(r.Signatures))
+	}
+	for i, res := range r.Signatures {
+		if res.Err != nil || res.SignedBy == nil {
+			t.Errorf("Signatures[%v] = %v, %v, want a valid signature", i, res.SignedBy, res.Err)
+		}
+	}
+}
+
+// opaqueHash hides the methods used to copy the state of a hash.
+type opaqueHash struct {
+	hash.Hash
+}
+
+func TestReader_signaturesOpaqueHash(t *testing.T) {
+	crypto.RegisterHash(crypto.SHA256, func() hash.Hash {
+		return opaqueHash{sha256.New()}
+	})
+	defer crypto.RegisterHash(crypto.SHA256, sha256.New)
+
+	other := newTestEntity(t, "Jane", "jane@example.org")
+	config := &packet.Config{DefaultHash: crypto.SHA256, Time: testConfig.Time}
+	msg := formatMultiSigned(t, testSignedMultiBody, []*openpgp.Entity{testPrivateKey, other}, config)
+
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPublicKey, other}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Reader.Verify() = %v", err)
+	}
+	if len(r.Signatures) != 2 {
+		t.Fatalf("len(Reader.Signatures) = %v, want 2", len(r.Signatures))
+	}
+	for i, res := range r.Signatures {
+		if res.Err != nil || res.SignedBy == nil {
+			t.Errorf("Signatures[%v] = %v, %v, want a valid signature", i, res.SignedBy, res.Err)
+		}
+	}
+}
+
+// signWithoutIssuer creates a signature without any issuer subpacket. The
+// packet is built by hand, because go-crypto always includes the issuer
+// fingerprint.
+func signWithoutIssuer(t *testing.T, body string, priv *packet.PrivateKey) []byte {
+	hashed := []byte{
+		5, 2, // creation time subpacket
+		0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(hashed[2:], uint32(testConfig.Now().Unix()))
+
+	header := []byte{4, packet.SigTypeText, byte(priv.PubKeyAlgo), 8 /* SHA256 */, 0, byte(len(hashed))}
+	header = append(header, hashed...)
+
+	h := sha256.New()
+	h.Write([]byte(body))
+	h.Write(header)
+	trailer := []byte{4, 0xFF, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(header)))
+	h.Write(trailer)
+	digest := h.Sum(nil)
+
+	sig, err := priv.PrivateKey.(crypto.Signer).Sign(nil, digest, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+
+	body2 := append([]byte(nil), header...)
+	body2 = append(body2, 0, 0) // no unhashed subpackets
+	body2 = append(body2, digest[:2]...)
+	sig = bytes.TrimLeft(sig, "\x00")
+	bitLen := len(sig) * 8
+	for i := 7; i >= 0 && sig[0]&(1<<uint(i)) == 0; i-- {
+		bitLen--
+	}
+	body2 = append(body2, byte(bitLen>>8), byte(bitLen))
+	body2 = append(body2, sig...)
+
+	pkt := []byte{0xC2, 0xFF, 0, 0, 0, 0} // new format signature packet
+	binary.BigEndian.PutUint32(pkt[2:], uint32(len(body2)))
+	return append(pkt, body2...)
+}
+
+func TestReader_signatureIssuerFingerprint(t *testing.T) {
+	priv := testPrivateKey.PrivateKey
+	sig := &packet.Signature{
+		Version:      4,
+		SigType:      packet.SigTypeText,
+		PubKeyAlgo:   priv.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: testConfig.Now(),
+	}
+	h := sha256.New()
+	h.Write([]byte(testSignedMultiBody))
+	if err := sig.Sign(h, priv, testConfig); err != nil {
+		t.Fatalf("Signature.Sign() = %v", err)
+	}
+	var sigs bytes.Buffer
+	if err := sig.Serialize(&sigs); err != nil {
+		t.Fatalf("Signature.Serialize() = %v", err)
+	}
+	msg := formatSignedPackets(t, testSignedMultiBody, sigs.Bytes())
+
+	r, err := Read(strings.NewReader(msg), openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("pgpmail.Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+	if len(r.Signatures) != 1 || !bytes.Equal(r.Signatures[0].IssuerFingerprint, testPublicKey.PrimaryKey.Fingerprint) {
+		t.Errorf("Reader.Signatures doesn't contain the issuer fingerprint")
+	}
+}
+
+func TestReader_signatureWithoutIssuer(t *testing.T) {
+	sigs := signWithoutIssuer(t, testSignedMultiBody, testPrivateKey.PrivateKey)
+	msg := formatSignedPackets(t, testSignedMultiBody, sigs)
+
+	for _, tryAll := range []bool{false, true} {
+		r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+			KeyRing:           openpgp.EntityList{testPublicKey},
+			TryAllSigningKeys: tryAll,
+		})
+		if err != nil {
+			t.Fatalf("pgpmail.ReadWithOptions() = %v", err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+			t.Fatalf("io.Copy() = %v", err)
+		}
+
+		if !tryAll {
+			if r.MessageDetails.SignatureError == nil {
+				t.Errorf("MessageDetails.SignatureError = nil without TryAllSigningKeys")
+			}
+			continue
+		}
+		checkSignature(t, r.MessageDetails)
+	}
+}
+
+// signAt signs body with the primary key of e, with the provided creation
+// time and lifetime.
+func signAt(t *testing.T, e *openpgp.Entity, body string, created time.Time, lifetime uint32) []byte {
+	sig := &packet.Signature{
+		Version:      4,
+		SigType:      packet.SigTypeText,
+		PubKeyAlgo:   e.PrivateKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: created,
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+	if lifetime != 0 {
+		sig.SigLifetimeSecs = &lifetime
+	}
+	h := sha256.New()
+	h.Write([]byte(body))
+	if err := sig.Sign(h, e.PrivateKey, nil); err != nil {
+		t.Fatalf("Signature.Sign() = %v", err)
+	}
+	var buf bytes.Buffer
+	if err := sig.Serialize(&buf); err != nil {
+		t.Fatalf("Signature.Serialize() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReader_signatureValidity(t *testing.T) {
+	now := testConfig.Now()
+	config := &packet.Config{Time: testConfig.Time}
+
+	revoked := newTestEntity(t, "Jane", "jane@example.org")
+	if err := revoked.RevokeKey(packet.KeyCompromised, "", config); err != nil {
+		t.Fatalf("Entity.RevokeKey() = %v", err)
+	}
+
+	superseded := newTestEntity(t, "Jane", "jane@example.org")
+	revokedAt := func() time.Time { return now.Add(time.Hour) }
+	if err := superseded.RevokeKey(packet.KeySuperseded, "", &packet.Config{Time: revokedAt}); err != nil {
+		t.Fatalf("Entity.RevokeKey() = %v", err)
+	}
+
+	expiring, err := openpgp.NewEntity("Jane", "", "jane@example.org", &packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		Time:            testConfig.Time,
+		KeyLifetimeSecs: 3600,
+	})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+
+	valid := newTestEntity(t, "Jane", "jane@example.org")
+
+	tests := []struct {
+		name     string
+		e        *openpgp.Entity
+		created  time.Time
+		lifetime uint32
+		want     error
+	}{
+		{"valid", valid, now, 0, nil},
+		{"revoked", revoked, now, 0, ErrKeyRevoked},
+		{"superseded before", superseded, now, 0, nil},
+		{"superseded after", superseded, now.Add(2 * time.Hour), 0, ErrKeyRevoked},
+		{"key expired", expiring, now.Add(2 * time.Hour), 0, ErrKeyExpired},
+		{"key not yet valid", valid, now.Add(-time.Hour), 0, ErrKeyNotYetValid},
+		{"signature expired", valid, now, 60, ErrSignatureExpired},
+		{"signature in the future", valid, now.Add(48 * time.Hour), 0, ErrSignatureInTheFuture},
+	}
+	for _, tc := range tests {
+		msg := formatSignedPackets(t, testSignedMultiBody, signAt(t, tc.e, testSignedMultiBody, tc.created, tc.lifetime))
+
+		r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+			KeyRing: openpgp.EntityList{tc.e},
+			Config:  &packet.Config{Time: func() time.Time { return now.Add(24 * time.Hour) }},
+		})
+		if err != nil {
+			t.Fatalf("%v: pgpmail.ReadWithOptions() = %v", tc.name, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+			t.Fatalf("%v: io.Copy() = %v", tc.name, err)
+		}
+
+		if err := r.MessageDetails.SignatureError; err != tc.want {
+			t.Errorf("%v: MessageDetails.SignatureError = %v, want %v", tc.name, err, tc.want)
+		}
+		if len(r.Signatures) != 1 || r.Signatures[0].SignedBy == nil {
+			t.Errorf("%v: Reader.Signatures doesn't contain the signing key", tc.name)
+		}
+	}
+}
+
+func TestReader_signatureValidityEncrypted(t *testing.T) {
+	now := testConfig.Now()
+	readConfig := &packet.Config{Time: func() time.Time { return now.Add(24 * time.Hour) }}
+
+	revoked := newTestEntity(t, "Jane", "jane@example.org")
+
+	expiring, err := openpgp.NewEntity("Jane", "", "jane@example.org", &packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		Time:            testConfig.Time,
+		KeyLifetimeSecs: 3600,
+	})
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity() = %v", err)
+	}
+
+	valid := newTestEntity(t, "Jane", "jane@example.org")
+
+	tests := []struct {
+		name     string
+		e        *openpgp.Entity
+		lifetime uint32
+		// detached is false if the error only applies to one-pass
+		// signatures: go-crypto checks the key at the current time instead
+		// of the signature creation time
+		detached bool
+		want     error
+	}{
+		{"revoked", revoked, 0, true, ErrKeyRevoked},
+		{"signature expired", valid, 60, true, ErrSignatureExpired},
+		{"key expired", expiring, 0, false, ErrKeyExpired},
+	}
+	for _, tc := range tests {
+		signConfig := &packet.Config{
+			DefaultHash:     crypto.SHA256,
+			Time:            testConfig.Time,
+			SigLifetimeSecs: tc.lifetime,
+		}
+		msgs := map[string]string{
+			"encrypted": formatEncryptedSigned(t, tc.e, signConfig),
+		}
+		if tc.detached {
+			msgs["detached"] = formatMultiSigned(t, testSignedMultiBody, []*openpgp.Entity{tc.e}, signConfig)
+		}
+		if tc.e == revoked {
+			if err := revoked.RevokeKey(packet.KeyCompromised, "", &packet.Config{Time: testConfig.Time}); err != nil {
+				t.Fatalf("Entity.RevokeKey() = %v", err)
+			}
+		}
+
+		for shape, msg := range msgs {
+			r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+				KeyRing: openpgp.EntityList{testPrivateKey, tc.e},
+				Config:  readConfig,
+			})
+			if err != nil {
+				t.Fatalf("%v, %v: pgpmail.ReadWithOptions() = %v", tc.name, shape, err)
+			}
+			if err := r.Verify(); !errors.Is(err, tc.want) {
+				t.Errorf("%v, %v: Reader.Verify() = %v, want %v", tc.name, shape, err, tc.want)
+			}
+			if len(r.Signatures) != 1 || r.Signatures[0].SignedBy == nil {
+				t.Errorf("%v, %v: Reader.Signatures doesn't contain the signing key", tc.name, shape)
+			}
+		}
+	}
+}
+
+func TestReader_signatureDateSkew(t *testing.T) {
+	now := testConfig.Now()
+	sigs := signAt(t, testPrivateKey, testSignedMultiBody, now, 0)
+
+	tests := []struct {
+		date time.Time
+		want error
+	}{
+		{now.Add(time.Minute), nil},
+		{now.Add(-2 * time.Hour), ErrDateSkew},
+		{now.Add(48 * time.Hour), ErrDateSkew},
+	}
+	for _, tc := range tests {
+		msg := "Date: " + tc.date.Format(time.RFC1123Z) + "\r\n" + formatSignedPackets(t, testSignedMultiBody, sigs)
+
+		r, err := ReadWithOptions(strings.NewReader(msg), &ReadOptions{
+			KeyRing:     openpgp.EntityList{testPublicKey},
+			MaxDateSkew: time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("pgpmail.ReadWithOptions() = %v", err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+			t.Fatalf("io.Copy() = %v", err)
+		}
+		if err := r.MessageDetails.SignatureError; err != tc.want {
+			t.Errorf("Date %v: MessageDetails.SignatureError = %v, want %v", tc.date, err, tc.want)
+		}
+	}
+}
+
+func TestReader_signaturePolicy(t *testing.T) {
+	errPolicy := errors.New("hash algorithm not allowed")
+	r, err := ReadWithOptions(strings.NewReader(testPGPMIMESigned), &ReadOptions{
+		KeyRing: openpgp.EntityList{testPublicKey},
+		SignaturePolicy: func(res *SignatureResult) error {
+			if res.Hash == crypto.SHA256 {
+				return errPolicy
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("pgpmail.ReadWithOptions() = %v", err)
+	}
+	if err := r.Verify(); err != errPolicy {
+		t.Errorf("Reader.Verify() = %v, want %v", err, errPolicy)
+	}
+}
@@ -0,0 +1,234 @@
+package pgpmail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/emersion/go-message/textproto"
+)
+
+// maxTreeDepth is the maximum nesting level of parts in ReadTree.
+const maxTreeDepth = 32
+
+// A Part is a node in the MIME tree of a message.
+//
+// When a PGP part is unwrapped, the Part describing it has a single child
+// containing the cleartext entity.
+type Part struct {
+	Header textproto.Header
+	// Body is the raw body of a non-multipart part.
+	Body []byte
+	// Children contains the sub-parts of a multipart part or the cleartext
+	// entity of a PGP part.
+	Children []*Part
+
+	// MessageDetails, InlineRanges, Recipients and Signatures are set when
+	// this part is a PGP part. They describe the PGP layer unwrapped at this
+	// part, see the Reader fields of the same name.
+	MessageDetails *openpgp.MessageDetails
+	InlineRanges   []InlineRange
+	Recipients     []Recipient
+	Signatures     []*SignatureResult
+	// Err is set if this part looks like a PGP part but couldn't be
+	// unwrapped, e.g. because of a missing key. In this case, Body contains
+	// the raw part body.
+	Err error
+
+	// IsEncrypted and IsSigned indicate whether this part is protected by an
+	// encryption or signature layer of one of its ancestors. SignedBy and
+	// SignatureError describe the innermost signature layer.
+	IsEncrypted    bool
+	IsSigned       bool
+	SignedBy       *openpgp.Key
+	SignatureError error
+}
+
+// Walk calls fn for p and each of its descendants, in depth-first order. If fn
+// returns an error, Walk stops and returns it.
+func (p *Part) Walk(fn func(p *Part) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+	for _, child := range p.Children {
+		if err := child.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTree reads a message and unwraps all PGP parts it contains, including
+// parts nested in other multipart entities.
+//
+// Bodies are read in memory.
+func ReadTree(r io.Reader, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Part, error) {
+	return ReadTreeWithOptions(r, &ReadOptions{
+		KeyRing:  keyring,
+		Prompt:   prompt,
+		Config:   config,
+		MaxDepth: maxTreeDepth,
+	})
+}
+
+// NewTree is like ReadTree, but takes an already parsed header.
+func NewTree(h textproto.Header, body io.Reader, keyring openpgp.KeyRing, prompt openpgp.PromptFunction, config *packet.Config) (*Part, error) {
+	return NewTreeWithOptions(h, body, &ReadOptions{
+		KeyRing:  keyring,
+		Prompt:   prompt,
+		Config:   config,
+		MaxDepth: maxTreeDepth,
+	})
+}
+
+// ReadTreeWithOptions is like ReadTree, but takes a ReadOptions. PGP parts
+// nested in the cleartext of other PGP parts are only unwrapped up to
+// options.MaxDepth layers.
+func ReadTreeWithOptions(r io.Reader, options *ReadOptions) (*Part, error) {
+	br := bufio.NewReader(r)
+
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, errorf(ErrMalformed, "pgpmail: failed to read header: %w", err)
+	}
+
+	return NewTreeWithOptions(h, br, options)
+}
+
+// NewTreeWithOptions is like NewTree, but takes a ReadOptions.
+func NewTreeWithOptions(h textproto.Header, body io.Reader, options *ReadOptions) (*Part, error) {
+	if options == nil {
+		options = &ReadOptions{}
+	}
+
+	// Nested layers are unwrapped as parts of the tree
+	readerOptions := *options
+	readerOptions.MaxDepth = 0
+
+	tr := &treeReader{options: &readerOptions, maxDepth: options.MaxDepth}
+	return tr.readPart(h, body, &Part{}, 0, 0)
+}
+
+type treeReader struct {
+	options  *ReadOptions
+	maxDepth int
+}
+
+// readPart reads a part. parent carries the protection inherited from the
+// ancestors, and layers is the number of PGP layers unwrapped in the
+// ancestors.
+func (tr *treeReader) readPart(h textproto.Header, body io.Reader, parent *Part, depth, layers int) (*Part, error) {
+	if depth > maxTreeDepth {
+		return nil, errorf(ErrUnsupported, "pgpmail: message is nested too deeply")
+	}
+
+	p := &Part{
+		Header:         h,
+		IsEncrypted:    parent.IsEncrypted,
+		IsSigned:       parent.IsSigned,
+		SignedBy:       parent.SignedBy,
+		SignatureError: parent.SignatureError,
+	}
+
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		t = "text/plain"
+	}
+
+	// text/plain parts may contain inline PGP data
+	isPGP := isPGPMIME(t, params) || strings.EqualFold(t, "text/plain")
+	if isPGP && layers <= tr.maxDepth {
+		raw, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := tr.readPGPPart(p, raw, depth, layers); err != nil {
+			p.Body = raw
+			p.Err = err
+		}
+		return p, nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(t), "multipart/") {
+		mr := textproto.NewMultipartReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errorf(ErrMalformed, "pgpmail: failed to read part: %w", err)
+			}
+
+			child, err := tr.readPart(part.Header, part, p, depth+1, layers)
+			if err != nil {
+				return nil, err
+			}
+			p.Children = append(p.Children, child)
+		}
+		return p, nil
+	}
+
+	p.Body, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (tr *treeReader) readPGPPart(p *Part, raw []byte, depth, layers int) error {
+	r, err := NewReaderWithOptions(p.Header, bytes.NewReader(raw), tr.options)
+	if err != nil {
+		return err
+	}
+
+	if r.InlineError != nil {
+		return r.InlineError
+	}
+
+	md := r.MessageDetails
+	if !md.IsEncrypted && !md.IsSigned {
+		p.Body = raw
+		return nil
+	}
+
+	// Reading the whole cleartext checks the signature
+	cleartext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return err
+	}
+
+	p.MessageDetails = md
+	p.InlineRanges = r.InlineRanges
+	p.Recipients = r.Recipients
+	p.Signatures = r.Signatures
+
+	layer := &Part{
+		IsEncrypted:    p.IsEncrypted || md.IsEncrypted,
+		IsSigned:       p.IsSigned,
+		SignedBy:       p.SignedBy,
+		SignatureError: p.SignatureError,
+	}
+	if md.IsSigned {
+		layer.IsSigned = true
+		layer.SignedBy = md.SignedBy
+		layer.SignatureError = md.SignatureError
+	}
+
+	br := bufio.NewReader(bytes.NewReader(cleartext))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return errorf(ErrMalformed, "pgpmail: failed to read cleartext header: %w", err)
+	}
+
+	child, err := tr.readPart(h, br, layer, depth+1, layers+1)
+	if err != nil {
+		return err
+	}
+	p.Children = []*Part{child}
+	return nil
+}
@@ -0,0 +1,156 @@
+package pgpmail
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestReadTree(t *testing.T) {
+	sr := strings.NewReader(testMixedSigned)
+	root, err := ReadTree(sr, openpgp.EntityList{testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("ReadTree() = %v", err)
+	}
+
+	if root.IsSigned || root.MessageDetails != nil {
+		t.Errorf("root part is signed")
+	}
+	if len(root.Children) != 2 {
+		t.Fatalf("root part has %v children, want 2", len(root.Children))
+	}
+
+	signed := root.Children[0]
+	if signed.MessageDetails == nil || !signed.MessageDetails.IsSigned {
+		t.Fatalf("first part isn't a signed PGP part")
+	}
+	if len(signed.Signatures) != 1 || signed.Signatures[0].SignedBy == nil {
+		t.Errorf("signed part: Signatures = %v, want a valid signature", signed.Signatures)
+	}
+	if len(signed.Children) != 1 {
+		t.Fatalf("signed part has %v children, want 1", len(signed.Children))
+	}
+	cleartext := signed.Children[0]
+	if !cleartext.IsSigned || cleartext.SignatureError != nil || cleartext.SignedBy == nil {
+		t.Errorf("signed part: IsSigned = %v, SignatureError = %v, SignedBy = %v", cleartext.IsSigned, cleartext.SignatureError, cleartext.SignedBy)
+	}
+	if s, want := string(cleartext.Body), "This is a signed message!\r\n"; s != want {
+		t.Errorf("signed part body = %q, want %q", s, want)
+	}
+
+	footer := root.Children[1]
+	if footer.IsSigned || footer.IsEncrypted {
+		t.Errorf("footer part is protected")
+	}
+	if s, want := string(footer.Body), "Mailing list footer"; s != want {
+		t.Errorf("footer part body = %q, want %q", s, want)
+	}
+
+	n := 0
+	root.Walk(func(p *Part) error {
+		n++
+		return nil
+	})
+	if n != 4 {
+		t.Errorf("Walk() visited %v parts, want 4", n)
+	}
+}
+
+func TestReadTree_inlineEncrypted(t *testing.T) {
+	root, err := ReadTree(strings.NewReader(testInlineEncrypted), openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("ReadTree() = %v", err)
+	}
+	if root.Err != nil || root.MessageDetails == nil || !root.MessageDetails.IsEncrypted {
+		t.Fatalf("root part: Err = %v, want an encrypted PGP part", root.Err)
+	}
+	if len(root.Recipients) != 1 {
+		t.Errorf("root part has %v recipients, want 1", len(root.Recipients))
+	}
+}
+
+func TestReadTree_inlineEncryptedMissingKey(t *testing.T) {
+	root, err := ReadTree(strings.NewReader(testInlineEncrypted), openpgp.EntityList(nil), nil, nil)
+	if err != nil {
+		t.Fatalf("ReadTree() = %v", err)
+	}
+
+	var missingKeyErr *MissingKeyError
+	if !errors.As(root.Err, &missingKeyErr) {
+		t.Errorf("root part: Err = %v, want a MissingKeyError", root.Err)
+	}
+	if root.MessageDetails != nil || len(root.Children) != 0 || len(root.Body) == 0 {
+		t.Errorf("root part isn't kept as-is")
+	}
+}
+
+var testMixedSigned = toCRLF(`From: John Doe <john.doe@example.org>
+To: John Doe <john.doe@example.org>
+Mime-Version: 1.0
+Content-Type: multipart/mixed; boundary=mixed
+
+--mixed
+Content-Type: multipart/signed; boundary=bar; micalg=pgp-sha256;
+   protocol="application/pgp-signature"
+
+--bar
+Content-Type: text/plain
+
+This is a signed message!
+
+--bar
+Content-Type: application/pgp-signature
+
+-----BEGIN PGP SIGNATURE-----
+
+iQEzBAABCAAdFiEEsahmk1QVO3mfIhe/MHIVwT33qWQFAl5FRLgACgkQMHIVwT33
+qWSEQQf/YgRlKlQzSyvm6A52lGIRU3F/z9EGjhCryxj+hSdPlk8O7iZFIjnco4Ea
+7QIlsOj6D4AlLdhyK6c8IZV7rZoTNE5rc6I5UZjM4Qa0XoyLjao28zR252TtwwWJ
+e4+wrTQKcVhCyHO6rkvcCpru4qF5CU+Mi8+sf8CNJJyBgw1Pri35rJWMdoTPTqqz
+kcIGN1JySaI8bbVitJQmnm0FtFTiB7zznv94rMBCiPmPUWd9BSpSBJteJoBLZ+K7
+Y7ws2Dzp2sBo/RLUM18oXd0N9PLXvFGI3IuF8ey1SPzQH3QbBdJSTmLzRlPjK7A1
+HVHFb3vTjd71z9j5IGQQ3Awdw30zMg==
+=gOul
+-----END PGP SIGNATURE-----
+
+--bar--
+
+--mixed
+Content-Type: text/plain
+
+Mailing list footer
+--mixed--
+`)
+
+func TestReadTreeWithOptions_maxDepth(t *testing.T) {
+	msg := tripleWrap(t, testSignedBody)
+
+	for _, tc := range []struct {
+		maxDepth, want int
+	}{
+		{0, 1},
+		{1, 2},
+		{maxTreeDepth, 3},
+	} {
+		root, err := ReadTreeWithOptions(strings.NewReader(msg), &ReadOptions{
+			KeyRing:  openpgp.EntityList{testPrivateKey},
+			MaxDepth: tc.maxDepth,
+		})
+		if err != nil {
+			t.Fatalf("ReadTreeWithOptions() = %v", err)
+		}
+
+		n := 0
+		root.Walk(func(p *Part) error {
+			if p.MessageDetails != nil {
+				n++
+			}
+			return nil
+		})
+		if n != tc.want {
+			t.Errorf("ReadTreeWithOptions() with MaxDepth = %v unwrapped %v layers, want %v", tc.maxDepth, n, tc.want)
+		}
+	}
+}
@@ -3,9 +3,12 @@ package pgpmail
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"mime"
+	"mime/quotedprintable"
+	"strings"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/armor"
@@ -28,7 +31,92 @@ func (mc multiCloser) Close() error {
 	return nil
 }
 
+// WriteOptions contains options for writing a message.
+type WriteOptions struct {
+	// Signer is the key used to sign the message. It is required by
+	// SignWithOptions, and optional for EncryptWithOptions.
+	Signer *openpgp.Entity
+	Config *packet.Config
+
+	// Autocrypt adds an Autocrypt header field advertising the signing key
+	// to the message header. If an encrypted message has multiple
+	// recipients, Autocrypt-Gossip header fields are added to the encrypted
+	// header.
+	Autocrypt     bool
+	PreferEncrypt PreferEncrypt
+
+	// ProtectHeaders enables RFC 9788 header protection. The header passed
+	// to EncryptWithOptions or SignWithOptions should then contain the full
+	// message header: the header fields are copied to the cleartext header,
+	// and for encrypted messages the outer header fields are obscured
+	// according to HCP. If HCP is nil, HCPBaseline is used. The header
+	// written to the returned io.WriteCloser should only contain the
+	// Content-* header fields of the cleartext entity.
+	ProtectHeaders bool
+	HCP            HCP
+
+	// EncodeBody makes SignWithOptions buffer the body of the signed entity
+	// and transfer-encode it with quoted-printable or base64 if it contains
+	// 8-bit data or long lines, so that the signature survives transport.
+	// The Content-Transfer-Encoding of the signed header is updated
+	// accordingly. Multipart and message bodies are left as-is.
+	EncodeBody bool
+
+	// Encapsulate makes EncryptWithOptions sign the message with a
+	// multipart/signed entity inside the multipart/encrypted entity, as
+	// described in RFC 3156 section 6.1, instead of using a combined
+	// OpenPGP signed and encrypted message. Signer is required.
+	Encapsulate bool
+
+	// Passphrases makes EncryptWithOptions encrypt the message to each of
+	// the passphrases, in addition to the public-key recipients. The
+	// recipients list can then be empty. The S2K parameters are taken from
+	// Config.
+	Passphrases [][]byte
+	// HideRecipients makes EncryptWithOptions use wildcard key IDs in
+	// session key packets, so that the recipients aren't disclosed. Readers
+	// need to try all of their keys to decrypt the message.
+	HideRecipients bool
+}
+
 func Encrypt(w io.Writer, h textproto.Header, to []*openpgp.Entity, signed *openpgp.Entity, config *packet.Config) (io.WriteCloser, error) {
+	return EncryptWithOptions(w, h, to, &WriteOptions{Signer: signed, Config: config})
+}
+
+// EncryptWithOptions is like Encrypt, but takes a WriteOptions.
+func EncryptWithOptions(w io.Writer, h textproto.Header, to []*openpgp.Entity, options *WriteOptions) (io.WriteCloser, error) {
+	if options == nil {
+		options = &WriteOptions{}
+	}
+	signed, config := options.Signer, options.Config
+	if options.Encapsulate && signed == nil {
+		return nil, errorf(ErrMissingKey, "pgpmail: missing signing key")
+	}
+
+	var gossip [][]byte
+	if options.Autocrypt {
+		if err := writeAutocrypt(&h, signed, options.PreferEncrypt, config.Now()); err != nil {
+			return nil, err
+		}
+		if len(to) > 1 {
+			var err error
+			gossip, err = autocryptGossip(h, to, config.Now())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var hp *headerProtection
+	if options.ProtectHeaders {
+		hcp := options.HCP
+		if hcp == nil {
+			hcp = HCPBaseline
+		}
+		hp = newHeaderProtection(h, HeaderProtectionCipher, hcp)
+		h = hp.outer
+	}
+
 	mw := textproto.NewMultipartWriter(w)
 
 	if forceBoundary != "" {
@@ -70,31 +158,84 @@ func Encrypt(w io.Writer, h textproto.Header, to []*openpgp.Entity, signed *open
 		return nil, err
 	}
 
-	plaintext, err := openpgp.EncryptText(armorWriter, to, signed, nil, config)
+	innerSigned := signed
+	if options.Encapsulate {
+		innerSigned = nil
+	}
+
+	var plaintext io.WriteCloser
+	if len(options.Passphrases) > 0 || options.HideRecipients {
+		plaintext, err = encryptMessage(armorWriter, to, innerSigned, options)
+	} else {
+		plaintext, err = encryptText(armorWriter, to, innerSigned, config)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return struct {
+	cleartext := plaintext
+	closers := multiCloser{plaintext, armorWriter, mw}
+	if options.Encapsulate {
+		// Gossip header fields are added to the multipart/signed header
+		var signedHeader textproto.Header
+		for i := len(gossip) - 1; i >= 0; i-- {
+			signedHeader.AddRaw(gossip[i])
+		}
+		gossip = nil
+
+		cleartext, err = SignWithOptions(plaintext, signedHeader, &WriteOptions{
+			Signer:     signed,
+			Config:     config,
+			EncodeBody: options.EncodeBody,
+		})
+		if err != nil {
+			return nil, err
+		}
+		closers = append(multiCloser{cleartext}, closers...)
+	}
+
+	wc := struct {
 		io.Writer
 		io.Closer
 	}{
-		plaintext,
-		multiCloser{
-			plaintext,
-			armorWriter,
-			mw,
-		},
-	}, nil
+		cleartext,
+		closers,
+	}
+
+	if len(gossip) == 0 && hp == nil {
+		return wc, nil
+	}
+
+	// Gossip and protected header fields need to be added to the encrypted
+	// header
+	handleHeader := func(encryptedHeader textproto.Header) (io.WriteCloser, error) {
+		if hp != nil {
+			if err := hp.protect(&encryptedHeader); err != nil {
+				return wc, err
+			}
+		}
+		if len(gossip) > 0 {
+			encryptedHeader.Del("Autocrypt-Gossip")
+			for i := len(gossip) - 1; i >= 0; i-- {
+				encryptedHeader.AddRaw(gossip[i])
+			}
+		}
+		if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+			return wc, err
+		}
+		return wc, nil
+	}
+	return &headerWriter{handle: handleHeader}, nil
 }
 
 type signer struct {
 	io.Writer
-	pw     *io.PipeWriter
-	done   <-chan error
-	sigBuf bytes.Buffer
-	mw     *textproto.MultipartWriter
-	closed bool
+	crlfWriter io.Closer
+	pw         *io.PipeWriter
+	done       <-chan error
+	sigBuf     bytes.Buffer
+	mw         *textproto.MultipartWriter
+	closed     bool
 }
 
 func (s *signer) Close() error {
@@ -103,6 +244,10 @@ func (s *signer) Close() error {
 	}
 	s.closed = true
 
+	if err := s.crlfWriter.Close(); err != nil {
+		return err
+	}
+
 	// Close the pipe to let openpgp.DetachSign finish
 	if err := s.pw.Close(); err != nil {
 		return err
@@ -138,6 +283,31 @@ func (s *signer) Close() error {
 }
 
 func Sign(w io.Writer, header textproto.Header, signed *openpgp.Entity, config *packet.Config) (io.WriteCloser, error) {
+	return SignWithOptions(w, header, &WriteOptions{Signer: signed, Config: config})
+}
+
+// SignWithOptions is like Sign, but takes a WriteOptions.
+func SignWithOptions(w io.Writer, header textproto.Header, options *WriteOptions) (io.WriteCloser, error) {
+	if options == nil {
+		options = &WriteOptions{}
+	}
+	signed, config := options.Signer, options.Config
+	if signed == nil {
+		return nil, errorf(ErrMissingKey, "pgpmail: missing signing key")
+	}
+
+	if options.Autocrypt {
+		if err := writeAutocrypt(&header, signed, options.PreferEncrypt, config.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	var hp *headerProtection
+	if options.ProtectHeaders {
+		hp = newHeaderProtection(header, HeaderProtectionClear, HCPNoConfidentiality)
+		header = hp.outer
+	}
+
 	// We need to grab the header written to the returned io.WriteCloser, then
 	// use it to create a new part in the multipart/signed message
 
@@ -155,7 +325,7 @@ func Sign(w io.Writer, header textproto.Header, signed *openpgp.Entity, config *
 		}
 	}
 	if micalg == "" {
-		return nil, fmt.Errorf("pgpmail: unknown hash algorithm %v", config.Hash())
+		return nil, errorf(ErrUnsupported, "pgpmail: unknown hash algorithm %v", config.Hash())
 	}
 
 	params := map[string]string{
@@ -169,20 +339,25 @@ func Sign(w io.Writer, header textproto.Header, signed *openpgp.Entity, config *
 		return nil, err
 	}
 
-	handleHeader := func(signedHeader textproto.Header) (io.WriteCloser, error) {
+	startSigning := func(signedHeader textproto.Header) (*signer, error) {
 		signedWriter, err := mw.CreatePart(signedHeader)
 		if err != nil {
 			return nil, err
 		}
-		// TODO: canonicalize text written to signedWriter
 
 		pr, pw := io.Pipe()
 		done := make(chan error, 1)
+
+		// Text needs to be canonicalized, otherwise the signature will be
+		// broken if the message is converted to CRLF during transport
+		crlfWriter := transform.NewWriter(io.MultiWriter(pw, signedWriter), &crlfTransformer{})
+
 		s := &signer{
-			Writer: io.MultiWriter(pw, signedWriter),
-			pw:     pw,
-			done:   done,
-			mw:     mw,
+			Writer:     crlfWriter,
+			crlfWriter: crlfWriter,
+			pw:         pw,
+			done:       done,
+			mw:         mw,
 		}
 
 		go func() {
@@ -200,9 +375,177 @@ func Sign(w io.Writer, header textproto.Header, signed *openpgp.Entity, config *
 		return s, nil
 	}
 
+	handleHeader := func(signedHeader textproto.Header) (io.WriteCloser, error) {
+		if hp != nil {
+			if err := hp.protect(&signedHeader); err != nil {
+				return nil, err
+			}
+		}
+
+		if options.EncodeBody && canEncodeBody(signedHeader) {
+			return &encodingSigner{header: signedHeader, start: startSigning}, nil
+		}
+		return startSigning(signedHeader)
+	}
+
 	return &headerWriter{handle: handleHeader}, nil
 }
 
+// maxLineLen is the maximum length of a line in a message, excluding the
+// CRLF, as defined in RFC 5322 section 2.1.1.
+const maxLineLen = 998
+
+// canEncodeBody returns true if the body of an entity can be transfer-encoded
+// with WriteOptions.EncodeBody.
+func canEncodeBody(h textproto.Header) bool {
+	t, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil {
+		t = strings.ToLower(t)
+		if strings.HasPrefix(t, "multipart/") || strings.HasPrefix(t, "message/") {
+			return false
+		}
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "", "7bit", "8bit", "binary":
+		return true
+	}
+	return false
+}
+
+// isTextEntity returns true if h is the header of a text entity, whose line
+// endings can be canonicalized. Entities without a valid Content-Type are
+// text/plain, see RFC 2045 section 5.2.
+func isTextEntity(h textproto.Header) bool {
+	t, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err != nil || strings.HasPrefix(strings.ToLower(t), "text/")
+}
+
+var fromLinePrefix = []byte("From ")
+
+// chooseTransferEncoding returns the Content-Transfer-Encoding needed to send
+// b over a 7-bit transport, or an empty string if b can be sent as-is.
+//
+// Trailing whitespace and lines starting with "From " are often altered in
+// transit, which breaks signatures, so they also need to be encoded.
+func chooseTransferEncoding(b []byte) string {
+	needsEncoding := false
+	lineLen := 0
+	for i, c := range b {
+		if lineLen == 0 && bytes.HasPrefix(b[i:], fromLinePrefix) {
+			needsEncoding = true
+		}
+
+		switch {
+		case c == ' ' || c == '\t':
+			if i+1 >= len(b) || b[i+1] == '\r' || b[i+1] == '\n' {
+				needsEncoding = true
+			}
+		case c == '\n':
+			lineLen = 0
+			continue
+		case c == '\r':
+			if i+1 >= len(b) || b[i+1] != '\n' {
+				// Lone CR characters can't be represented in text
+				return "base64"
+			}
+			continue
+		case c == 0 || (c < ' ' && c != '\t') || c == 0x7F:
+			return "base64"
+		case c >= 0x80:
+			needsEncoding = true
+		}
+
+		lineLen++
+		if lineLen > maxLineLen {
+			needsEncoding = true
+		}
+	}
+
+	if needsEncoding {
+		return "quoted-printable"
+	}
+	return ""
+}
+
+// base64LineLen is the length of base64-encoded lines, see RFC 2045 section
+// 6.8.
+const base64LineLen = 76
+
+// encodingSigner buffers the body of the signed entity, so that a
+// Content-Transfer-Encoding can be picked before starting to sign it.
+type encodingSigner struct {
+	buf    bytes.Buffer
+	header textproto.Header
+	start  func(textproto.Header) (*signer, error)
+}
+
+func (es *encodingSigner) Write(b []byte) (int, error) {
+	return es.buf.Write(b)
+}
+
+func (es *encodingSigner) Close() error {
+	body := es.buf.Bytes()
+
+	var encoded bytes.Buffer
+	enc := chooseTransferEncoding(body)
+	switch enc {
+	case "quoted-printable":
+		body, _, err := transform.Bytes(&crlfTransformer{}, body)
+		if err != nil {
+			return err
+		}
+		qpWriter := quotedprintable.NewWriter(&encoded)
+		if _, err := qpWriter.Write(body); err != nil {
+			return err
+		}
+		if err := qpWriter.Close(); err != nil {
+			return err
+		}
+
+		// quotedprintable doesn't escape "From " at the start of lines
+		b := bytes.ReplaceAll(encoded.Bytes(), []byte("\r\nFrom "), []byte("\r\n=46rom "))
+		if bytes.HasPrefix(b, fromLinePrefix) {
+			b = append([]byte("=46"), b[1:]...)
+		}
+		encoded.Reset()
+		encoded.Write(b)
+	case "base64":
+		if isTextEntity(es.header) {
+			var err error
+			body, _, err = transform.Bytes(&crlfTransformer{}, body)
+			if err != nil {
+				return err
+			}
+		}
+		s := base64.StdEncoding.EncodeToString(body)
+		for len(s) > 0 {
+			n := base64LineLen
+			if n > len(s) {
+				n = len(s)
+			}
+			encoded.WriteString(s[:n] + "\r\n")
+			s = s[n:]
+		}
+	default:
+		encoded.Write(body)
+	}
+
+	if enc != "" {
+		es.header.Set("Content-Transfer-Encoding", enc)
+	}
+
+	s, err := es.start(es.header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(s, &encoded); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
 var (
 	doubleCRLF = []byte("\r\n\r\n")
 	doubleLF   = []byte("\n\n")
@@ -299,21 +642,13 @@ type crlfTransformer struct {
 
 func (tr *crlfTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
 	for _, c := range src {
-		if c == '\r' {
-			tr.cr = true
-		}
-
-		if c == '\n' {
-			if tr.cr {
-				tr.cr = false
-			} else {
-				if nDst+1 >= len(dst) {
-					err = transform.ErrShortDst
-					break
-				}
-				dst[nDst] = '\r'
-				nDst++
+		if c == '\n' && !tr.cr {
+			if nDst+2 > len(dst) {
+				err = transform.ErrShortDst
+				break
 			}
+			dst[nDst] = '\r'
+			nDst++
 		}
 
 		if nDst >= len(dst) {
@@ -323,6 +658,7 @@ func (tr *crlfTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc in
 		dst[nDst] = c
 		nDst++
 		nSrc++
+		tr.cr = c == '\r'
 	}
 	return nDst, nSrc, err
 }
@@ -1,13 +1,19 @@
 package pgpmail
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"errors"
 	"io"
 	"io/ioutil"
+	"mime"
 	"strings"
 	"testing"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/emersion/go-message/textproto"
 )
 
@@ -159,3 +165,520 @@ var wantSignedSuffix = toCRLF(`
 -----END PGP MESSAGE-----
 --foo--
 `)
+
+func TestSign_lf(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	cleartext, err := Sign(&buf, h, testPrivateKey, testConfig)
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "Content-Type: text/plain\n\nThis is a signed message!\nWith two lines.\n"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	if s := buf.String(); !strings.Contains(s, "This is a signed message!\r\nWith two lines.\r\n") {
+		t.Errorf("Sign() didn't canonicalize line endings:\n%q", s)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r.MessageDetails.UnverifiedBody); err != nil {
+		t.Fatalf("io.Copy() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+}
+
+func TestSignWithOptions_encodeBody(t *testing.T) {
+	tests := []struct {
+		name, body, enc string
+	}{
+		{"7bit", "This is a signed message!\r\n", ""},
+		{"8bit", "Ceci est un message signé !\n", "quoted-printable"},
+		{"long", strings.Repeat("a", 1000) + "\r\n", "quoted-printable"},
+		{"binary", "\x00\x01\x02\r\xff", "base64"},
+		{"binary-lf", "\x00\x01\x02\nline\n", "base64"},
+		{"trailing-whitespace", "Trailing space \r\nand tab\t\r\n", "quoted-printable"},
+		{"from", "From the start\r\nFrom the middle\r\n", "quoted-printable"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var h textproto.Header
+			h.Set("From", "John Doe <john.doe@example.org>")
+			h.Set("To", "John Doe <john.doe@example.org>")
+
+			var signedHeader textproto.Header
+			signedHeader.Set("Content-Type", "text/plain; charset=utf-8")
+
+			var buf bytes.Buffer
+			cleartext, err := SignWithOptions(&buf, h, &WriteOptions{
+				Signer:     testPrivateKey,
+				Config:     testConfig,
+				EncodeBody: true,
+			})
+			if err != nil {
+				t.Fatalf("SignWithOptions() = %v", err)
+			}
+			if err := textproto.WriteHeader(cleartext, signedHeader); err != nil {
+				t.Fatalf("textproto.WriteHeader() = %v", err)
+			}
+			if _, err := io.WriteString(cleartext, tc.body); err != nil {
+				t.Fatalf("io.WriteString() = %v", err)
+			}
+			if err := cleartext.Close(); err != nil {
+				t.Fatalf("cleartext.Close() = %v", err)
+			}
+
+			for _, l := range strings.Split(buf.String(), "\r\n") {
+				if len(l) > 998 {
+					t.Errorf("Sign() wrote a line longer than 998 characters")
+				}
+				if strings.HasPrefix(l, "From ") || strings.HasSuffix(l, " ") || strings.HasSuffix(l, "\t") {
+					t.Errorf("Sign() wrote a line which may be altered in transit: %q", l)
+				}
+				for _, c := range []byte(l) {
+					if c >= 0x80 {
+						t.Fatalf("Sign() wrote 8-bit data: %q", l)
+					}
+				}
+			}
+
+			r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+			if err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			br := bufio.NewReader(r.MessageDetails.UnverifiedBody)
+			signedHeader, err = textproto.ReadHeader(br)
+			if err != nil {
+				t.Fatalf("textproto.ReadHeader() = %v", err)
+			}
+			encoded, err := ioutil.ReadAll(br)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+			checkSignature(t, r.MessageDetails)
+
+			if enc := signedHeader.Get("Content-Transfer-Encoding"); enc != tc.enc {
+				t.Errorf("Content-Transfer-Encoding = %q, want %q", enc, tc.enc)
+			}
+
+			decoded, err := decodeTransferEncoding(tc.enc, bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("decodeTransferEncoding() = %v", err)
+			}
+			b, err := ioutil.ReadAll(decoded)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+			// Text is canonicalized, whatever the transfer encoding
+			want := toCRLF(strings.ReplaceAll(tc.body, "\r\n", "\n"))
+			if string(b) != want {
+				t.Errorf("Decoded body = %q, want %q", b, want)
+			}
+		})
+	}
+}
+
+func TestSignWithOptions(t *testing.T) {
+	var h textproto.Header
+	h.Set("Subject", "Signed subject")
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var signedHeader textproto.Header
+	signedHeader.Set("Content-Type", "text/plain")
+
+	var buf bytes.Buffer
+	cleartext, err := SignWithOptions(&buf, h, &WriteOptions{
+		Signer:         testPrivateKey,
+		Config:         testConfig,
+		Autocrypt:      true,
+		PreferEncrypt:  PreferEncryptMutual,
+		ProtectHeaders: true,
+	})
+	if err != nil {
+		t.Fatalf("SignWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, signedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "This is a signed message!"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := ReadWithOptions(&buf, &ReadOptions{KeyRing: openpgp.EntityList{testPrivateKey}})
+	if err != nil {
+		t.Fatalf("ReadWithOptions() = %v", err)
+	}
+	if err := r.ReadProtectedHeader(); err != nil {
+		t.Fatalf("Reader.ReadProtectedHeader() = %v", err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Reader.Verify() = %v", err)
+	}
+	if !r.Header.Has("Autocrypt") {
+		t.Errorf("Header doesn't contain an Autocrypt header field")
+	}
+	if r.HeaderProtection != HeaderProtectionClear {
+		t.Errorf("Reader.HeaderProtection = %q, want %q", r.HeaderProtection, HeaderProtectionClear)
+	}
+}
+
+func TestSignWithOptions_noSigner(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := SignWithOptions(&buf, textproto.Header{}, &WriteOptions{Config: testConfig}); err == nil {
+		t.Errorf("SignWithOptions() without a signer succeeded")
+	}
+}
+
+func TestEncryptWithOptions_encapsulate(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	var encryptedBody = "This is an encrypted message!\n"
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, []*openpgp.Entity{testPublicKey}, &WriteOptions{
+		Signer:      testPrivateKey,
+		Config:      testConfig,
+		Encapsulate: true,
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, encryptedBody); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{testPrivateKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	checkSignature(t, r.MessageDetails)
+	checkEncryption(t, r.MessageDetails)
+	if len(r.Signatures) != 1 {
+		t.Errorf("len(Reader.Signatures) = %v, want a detached signature", len(r.Signatures))
+	}
+	if typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); typ != "multipart/encrypted" {
+		t.Errorf("Content-Type = %q, want multipart/encrypted", typ)
+	}
+	for _, k := range []string{"From", "To"} {
+		if got, want := r.Header.Get(k), h.Get(k); got != want {
+			t.Errorf("Header.Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+
+	want := formatMessage(encryptedHeader, toCRLF(encryptedBody))
+	if s := string(b); s != want {
+		t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, want)
+	}
+}
+
+func TestEncryptWithOptions_passphrase(t *testing.T) {
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	var encryptedBody = "This is an encrypted message!\n"
+	passphrase := []byte("correct horse battery staple")
+
+	tests := []struct {
+		name   string
+		to     []*openpgp.Entity
+		signed *openpgp.Entity
+	}{
+		{"passphrase", nil, nil},
+		{"passphrase-signed", nil, testPrivateKey},
+		{"passphrase-and-key", []*openpgp.Entity{testPublicKey}, testPrivateKey},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cleartext, err := EncryptWithOptions(&buf, h.Copy(), tc.to, &WriteOptions{
+				Signer:      tc.signed,
+				Config:      testConfig,
+				Passphrases: [][]byte{[]byte("wrong"), passphrase},
+			})
+			if err != nil {
+				t.Fatalf("EncryptWithOptions() = %v", err)
+			}
+			if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+				t.Fatalf("textproto.WriteHeader() = %v", err)
+			}
+			if _, err := io.WriteString(cleartext, encryptedBody); err != nil {
+				t.Fatalf("io.WriteString() = %v", err)
+			}
+			if err := cleartext.Close(); err != nil {
+				t.Fatalf("cleartext.Close() = %v", err)
+			}
+			encrypted := buf.Bytes()
+
+			prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+				if !symmetric {
+					t.Fatalf("prompt called without symmetric key")
+				}
+				return passphrase, nil
+			}
+			r, err := Read(bytes.NewReader(encrypted), openpgp.EntityList{testPublicKey}, prompt, nil)
+			if err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+			if !r.MessageDetails.IsEncrypted || !r.MessageDetails.IsSymmetricallyEncrypted {
+				t.Errorf("MessageDetails = %+v, want symmetrically encrypted", r.MessageDetails)
+			}
+			if tc.signed != nil {
+				checkSignature(t, r.MessageDetails)
+				if sig := r.MessageDetails.Signature; sig == nil || sig.SigType != packet.SigTypeText {
+					t.Errorf("MessageDetails.Signature = %+v, want a text signature", sig)
+				}
+			} else if r.MessageDetails.IsSigned {
+				t.Errorf("MessageDetails.IsSigned = true, want false")
+			}
+
+			want := formatMessage(encryptedHeader, toCRLF(encryptedBody))
+			if s := string(b); s != want {
+				t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, want)
+			}
+
+			if tc.to == nil {
+				return
+			}
+			r, err = Read(bytes.NewReader(encrypted), openpgp.EntityList{testPrivateKey}, nil, nil)
+			if err != nil {
+				t.Fatalf("Read() with private key = %v", err)
+			}
+			if _, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody); err != nil {
+				t.Fatalf("ReadAll() with private key = %v", err)
+			}
+			checkEncryption(t, r.MessageDetails)
+		})
+	}
+}
+
+// encryptedPackets returns the first session key packet and the encrypted
+// data packet of a PGP/MIME encrypted message.
+func encryptedPackets(t *testing.T, msg []byte) (*packet.SymmetricKeyEncrypted, *packet.SymmetricallyEncrypted) {
+	i := bytes.Index(msg, []byte("-----BEGIN PGP MESSAGE-----"))
+	if i < 0 {
+		t.Fatalf("missing PGP message")
+	}
+	block, err := armor.Decode(bytes.NewReader(msg[i:]))
+	if err != nil {
+		t.Fatalf("armor.Decode() = %v", err)
+	}
+
+	var skesk *packet.SymmetricKeyEncrypted
+	pr := packet.NewReader(block.Body)
+	for {
+		p, err := pr.Next()
+		if err != nil {
+			t.Fatalf("packet.Reader.Next() = %v", err)
+		}
+		switch p := p.(type) {
+		case *packet.SymmetricKeyEncrypted:
+			if skesk == nil {
+				skesk = p
+			}
+		case *packet.SymmetricallyEncrypted:
+			return skesk, p
+		}
+	}
+}
+
+func TestEncryptWithOptions_negotiation(t *testing.T) {
+	config := *testConfig
+	config.AEADConfig = &packet.AEADConfig{}
+	passphrase := []byte("correct horse battery staple")
+
+	tests := []struct {
+		name    string
+		to      []*openpgp.Entity
+		version int
+	}{
+		// AEAD can be used if there are no public-key recipients
+		{"passphrase", nil, 2},
+		// The test key doesn't support AEAD
+		{"passphrase-and-key", []*openpgp.Entity{testPublicKey}, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var h textproto.Header
+			h.Set("From", "John Doe <john.doe@example.org>")
+
+			var buf bytes.Buffer
+			cleartext, err := EncryptWithOptions(&buf, h, tc.to, &WriteOptions{
+				Config:      &config,
+				Passphrases: [][]byte{passphrase},
+			})
+			if err != nil {
+				t.Fatalf("EncryptWithOptions() = %v", err)
+			}
+			if _, err := io.WriteString(cleartext, "Content-Type: text/plain\r\n\r\nHi!\r\n"); err != nil {
+				t.Fatalf("io.WriteString() = %v", err)
+			}
+			if err := cleartext.Close(); err != nil {
+				t.Fatalf("cleartext.Close() = %v", err)
+			}
+
+			skesk, seipd := encryptedPackets(t, buf.Bytes())
+			if seipd.Version != tc.version {
+				t.Errorf("SymmetricallyEncrypted.Version = %v, want %v", seipd.Version, tc.version)
+			}
+			if wantSKESK := tc.version + 3; skesk.Version != wantSKESK {
+				t.Errorf("SymmetricKeyEncrypted.Version = %v, want %v", skesk.Version, wantSKESK)
+			}
+
+			prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+				return passphrase, nil
+			}
+			r, err := Read(bytes.NewReader(buf.Bytes()), openpgp.EntityList(nil), prompt, nil)
+			if err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			if _, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody); err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptWithOptions_negotiationHash(t *testing.T) {
+	rcpt := newTestEntity(t, "Jane", "jane@example.org")
+	rcpt.PrimaryIdentity().SelfSignature.PreferredHash = []uint8{10} // SHA512
+
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, []*openpgp.Entity{rcpt}, &WriteOptions{
+		Signer:      testPrivateKey,
+		Config:      testConfig,
+		Passphrases: [][]byte{[]byte("correct horse battery staple")},
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, "Content-Type: text/plain\r\n\r\nHi!\r\n"); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+
+	r, err := Read(&buf, openpgp.EntityList{rcpt, testPublicKey}, nil, nil)
+	if err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Fatalf("Reader.Verify() = %v", err)
+	}
+	if len(r.Signatures) != 1 || r.Signatures[0].Hash != crypto.SHA512 {
+		t.Errorf("Reader.Signatures = %v, want a single SHA-512 signature", r.Signatures)
+	}
+}
+
+func TestEncryptWithOptions_hideRecipients(t *testing.T) {
+	other := newTestEntity(t, "Jane", "jane@example.org")
+	unrelated := newTestEntity(t, "Mallory", "mallory@example.org")
+
+	var h textproto.Header
+	h.Set("From", "John Doe <john.doe@example.org>")
+	h.Set("To", "John Doe <john.doe@example.org>")
+
+	var encryptedHeader textproto.Header
+	encryptedHeader.Set("Content-Type", "text/plain")
+
+	var encryptedBody = "This is an encrypted message!\n"
+
+	var buf bytes.Buffer
+	cleartext, err := EncryptWithOptions(&buf, h, []*openpgp.Entity{other, testPublicKey}, &WriteOptions{
+		Signer:         testPrivateKey,
+		Config:         testConfig,
+		HideRecipients: true,
+	})
+	if err != nil {
+		t.Fatalf("EncryptWithOptions() = %v", err)
+	}
+	if err := textproto.WriteHeader(cleartext, encryptedHeader); err != nil {
+		t.Fatalf("textproto.WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(cleartext, encryptedBody); err != nil {
+		t.Fatalf("io.WriteString() = %v", err)
+	}
+	if err := cleartext.Close(); err != nil {
+		t.Fatalf("cleartext.Close() = %v", err)
+	}
+	encrypted := buf.Bytes()
+
+	for _, e := range []*openpgp.Entity{other, testPrivateKey} {
+		// The unrelated key comes first, so that all keys need to be tried
+		keyring := openpgp.EntityList{unrelated, e, testPublicKey}
+		r, err := Read(bytes.NewReader(encrypted), keyring, nil, nil)
+		if err != nil {
+			t.Fatalf("Read() = %v", err)
+		}
+		b, err := ioutil.ReadAll(r.MessageDetails.UnverifiedBody)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		checkSignature(t, r.MessageDetails)
+		if r.MessageDetails.DecryptedWith.Entity != e {
+			t.Errorf("MessageDetails.DecryptedWith = %v, want %v", r.MessageDetails.DecryptedWith.Entity.PrimaryKey.KeyIdString(), e.PrimaryKey.KeyIdString())
+		}
+
+		if len(r.Recipients) != 2 {
+			t.Fatalf("len(Reader.Recipients) = %v, want 2", len(r.Recipients))
+		}
+		for _, rcpt := range r.Recipients {
+			if !rcpt.Hidden || rcpt.KeyId != 0 || rcpt.Fingerprint != nil {
+				t.Errorf("Recipient = %+v, want a hidden recipient", rcpt)
+			}
+		}
+
+		want := formatMessage(encryptedHeader, toCRLF(encryptedBody))
+		if s := string(b); s != want {
+			t.Errorf("MessagesDetails.UnverifiedBody = \n%v\n but want \n%v", s, want)
+		}
+	}
+
+	_, err = Read(bytes.NewReader(encrypted), openpgp.EntityList{unrelated}, nil, nil)
+	var missingKeyErr *MissingKeyError
+	if !errors.As(err, &missingKeyErr) {
+		t.Fatalf("Read() = %v, want a MissingKeyError", err)
+	}
+	if len(missingKeyErr.Recipients) != 2 || !missingKeyErr.Recipients[0].Hidden {
+		t.Errorf("MissingKeyError.Recipients = %+v, want two hidden recipients", missingKeyErr.Recipients)
+	}
+}